@@ -20,8 +20,48 @@ var (
 	redisUsername   string
 	redisPassword   string
 	redisExpiration time.Duration
+	redisNamespace  string
 	domain          string
+	domainFile      string
 	minDomain       int
+	idleTimeout     time.Duration
+	reapInterval    time.Duration
+	verifyDomains   bool
+	challengeExp    time.Duration
+	quota           int
+	quotaPublic     int
+	quotaPrivate    int
+	balance         string
+	allocMode       string
+	allocLength     int
+	allocAlphabet   string
+	policyFile      string
+	policyReload    time.Duration
+	eventChannel    string
+	eventExpired    bool
+	cacheSize       int
+	cacheTTL        time.Duration
+	cacheNegTTL     time.Duration
+	httpAddr        string
+	adminAddr       string
+	adminToken      string
+
+	sweepInterval  time.Duration
+	zoneFile       string
+	authFile       string
+	tlsCert        string
+	tlsKey         string
+	tlsClientCA    string
+	conflict       string
+	renewMissing   string
+	sdEventChannel string
+	sdAdminAddr    string
+	sdAdminToken   string
+	probeInterval  time.Duration
+	probeTimeout   time.Duration
+	healthFailures int
+	healthCooldown time.Duration
+	healthExclude  bool
 
 	mongoURI string
 	mongoDB  string
@@ -32,6 +72,9 @@ var (
 	limitIn  int
 	limitOut int
 
+	migrateRedisAddr string
+	dryRun           bool
+
 	// log flags
 	logLevel  string
 	logFormat string
@@ -88,13 +131,36 @@ func init() {
 		Long:  "Ingress plugin for GOST.PLUS",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return ingress.ListenAndServe(addr, &ingress.Options{
-				RedisAddr:       redisAddr,
-				RedisDB:         redisDB,
-				RedisUsername:   redisUsername,
-				RedisPassword:   redisPassword,
-				RedisExpiration: redisExpiration,
-				Domains:         strings.Split(domain, ","),
-				MinDomain:       minDomain,
+				RedisAddr:           redisAddr,
+				RedisDB:             redisDB,
+				RedisUsername:       redisUsername,
+				RedisPassword:       redisPassword,
+				RedisExpiration:     redisExpiration,
+				Namespace:           redisNamespace,
+				Domains:             strings.Split(domain, ","),
+				MinDomain:           minDomain,
+				DomainFile:          domainFile,
+				IdleTimeout:         idleTimeout,
+				ReapInterval:        reapInterval,
+				VerifyDomains:       verifyDomains,
+				ChallengeExpiration: challengeExp,
+				Quota:               quota,
+				QuotaPublic:         quotaPublic,
+				QuotaPrivate:        quotaPrivate,
+				Balance:             balance,
+				AllocMode:           allocMode,
+				AllocLength:         allocLength,
+				AllocAlphabet:       allocAlphabet,
+				PolicyFile:          policyFile,
+				PolicyReload:        policyReload,
+				EventChannel:        eventChannel,
+				EventExpired:        eventExpired,
+				CacheSize:           cacheSize,
+				CacheTTL:            cacheTTL,
+				CacheNegativeTTL:    cacheNegTTL,
+				HTTPAddr:            httpAddr,
+				AdminAddr:           adminAddr,
+				AdminToken:          adminToken,
 			})
 		},
 	}
@@ -103,8 +169,31 @@ func init() {
 	ingressCmd.Flags().StringVar(&redisUsername, "redis.username", "", "redis username")
 	ingressCmd.Flags().StringVar(&redisPassword, "redis.password", "", "redis password")
 	ingressCmd.Flags().DurationVar(&redisExpiration, "redis.expiration", time.Hour, "redis key expiration")
+	ingressCmd.Flags().StringVar(&redisNamespace, "redis.namespace", "", "redis key namespace, empty for unprefixed keys")
 	ingressCmd.Flags().StringVar(&domain, "domain", "gost.run", "domain name or comma separated domain list")
 	ingressCmd.Flags().IntVar(&minDomain, "domain.min", 1, "minimum length of domain prefix")
+	ingressCmd.Flags().StringVar(&domainFile, "domain.file", "", "JSON file of per-domain settings")
+	ingressCmd.Flags().DurationVar(&idleTimeout, "reaper.idle", 0, "free rules not refreshed within this duration, 0 to disable")
+	ingressCmd.Flags().DurationVar(&reapInterval, "reaper.interval", time.Minute, "interval of the idle rule reaper")
+	ingressCmd.Flags().BoolVar(&verifyDomains, "domain.verify", false, "require custom domains to pass a DNS TXT or HTTP challenge")
+	ingressCmd.Flags().DurationVar(&challengeExp, "domain.challenge", 24*time.Hour, "lifetime of a custom domain challenge token")
+	ingressCmd.Flags().IntVar(&quota, "quota", 0, "maximum number of rules per tunnel, 0 for no limit")
+	ingressCmd.Flags().IntVar(&quotaPublic, "quota.public", 0, "maximum number of rules per public tunnel, overrides --quota")
+	ingressCmd.Flags().IntVar(&quotaPrivate, "quota.private", 0, "maximum number of rules per private tunnel, overrides --quota")
+	ingressCmd.Flags().StringVar(&balance, "balance", ingress.BalanceRoundRobin, "strategy to select one of the tunnels serving a host: round, random or hash")
+	ingressCmd.Flags().StringVar(&allocMode, "alloc.mode", ingress.AllocSlug, "generated host name style: slug or word")
+	ingressCmd.Flags().IntVar(&allocLength, "alloc.length", 8, "length of generated slug host names")
+	ingressCmd.Flags().StringVar(&allocAlphabet, "alloc.alphabet", "abcdefghijklmnopqrstuvwxyz0123456789", "characters of generated slug host names")
+	ingressCmd.Flags().StringVar(&policyFile, "policy.file", "", "JSON file of reserved and denied host names")
+	ingressCmd.Flags().DurationVar(&policyReload, "policy.reload", 30*time.Second, "interval to check the policy file for changes, 0 to disable")
+	ingressCmd.Flags().StringVar(&eventChannel, "event.channel", ingress.DefaultEventChannel, "redis pub/sub channel of rule change events, empty to disable")
+	ingressCmd.Flags().BoolVar(&eventExpired, "event.expired", false, "publish events for expired rules using redis keyspace notifications")
+	ingressCmd.Flags().IntVar(&cacheSize, "cache.size", 0, "maximum number of cached rules, 0 to disable the cache")
+	ingressCmd.Flags().DurationVar(&cacheTTL, "cache.ttl", 30*time.Second, "lifetime of cached rules")
+	ingressCmd.Flags().DurationVar(&cacheNegTTL, "cache.negative", 5*time.Second, "lifetime of cached missing rules")
+	ingressCmd.Flags().StringVar(&httpAddr, "http.addr", "", "HTTP plugin service address with path rule lookups, empty to disable")
+	ingressCmd.Flags().StringVar(&adminAddr, "admin.addr", "", "admin HTTP API address, empty to disable")
+	ingressCmd.Flags().StringVar(&adminToken, "admin.token", "", "admin HTTP API bearer token for forced operations")
 
 	sdCmd := &cobra.Command{
 		Use:   "sd",
@@ -117,6 +206,23 @@ func init() {
 				RedisUsername:   redisUsername,
 				RedisPassword:   redisPassword,
 				RedisExpiration: redisExpiration,
+				Namespace:       redisNamespace,
+				SweepInterval:   sweepInterval,
+				EventChannel:    sdEventChannel,
+				ZoneFile:        zoneFile,
+				AuthFile:        authFile,
+				TLSCertFile:     tlsCert,
+				TLSKeyFile:      tlsKey,
+				TLSClientCAFile: tlsClientCA,
+				Conflict:        conflict,
+				RenewMissing:    renewMissing,
+				ProbeInterval:   probeInterval,
+				ProbeTimeout:    probeTimeout,
+				HealthFailures:  healthFailures,
+				HealthCooldown:  healthCooldown,
+				HealthExclude:   healthExclude,
+				AdminAddr:       sdAdminAddr,
+				AdminToken:      sdAdminToken,
 			})
 		},
 	}
@@ -125,6 +231,23 @@ func init() {
 	sdCmd.Flags().StringVar(&redisUsername, "redis.username", "", "redis username")
 	sdCmd.Flags().StringVar(&redisPassword, "redis.password", "", "redis password")
 	sdCmd.Flags().DurationVar(&redisExpiration, "redis.expiration", time.Minute, "redis key expiration")
+	sdCmd.Flags().StringVar(&redisNamespace, "redis.namespace", "", "redis key namespace, empty for unprefixed keys")
+	sdCmd.Flags().DurationVar(&sweepInterval, "sweep.interval", time.Minute, "interval of deleting instances not renewed within --redis.expiration, 0 to disable")
+	sdCmd.Flags().StringVar(&sdEventChannel, "event.channel", sd.DefaultEventChannel, "redis pub/sub channel of instance change events, empty to disable them and the watch API")
+	sdCmd.Flags().StringVar(&zoneFile, "zone.file", "", "JSON file mapping CIDR networks to zones and regions")
+	sdCmd.Flags().StringVar(&authFile, "auth.file", "", "JSON file of the tokens, service secrets and service owners of registering callers")
+	sdCmd.Flags().StringVar(&tlsCert, "tls.cert", "", "TLS certificate file of the gRPC server")
+	sdCmd.Flags().StringVar(&tlsKey, "tls.key", "", "TLS key file of the gRPC server")
+	sdCmd.Flags().StringVar(&tlsClientCA, "tls.ca", "", "CA file verifying client certificates, which identify callers by their common name")
+	sdCmd.Flags().StringVar(&conflict, "conflict", sd.ConflictReplace, "policy for an instance ID registered by another live connector: replace or reject")
+	sdCmd.Flags().StringVar(&renewMissing, "renew.missing", sd.RenewMissingReply, "renewal of an instance that is not registered: reply, notfound or recreate")
+	sdCmd.Flags().DurationVar(&probeInterval, "health.probe", 0, "interval of active TCP/UDP probes of the instances, 0 to disable")
+	sdCmd.Flags().DurationVar(&probeTimeout, "health.timeout", 3*time.Second, "timeout of a single probe")
+	sdCmd.Flags().IntVar(&healthFailures, "health.failures", 3, "consecutive failures after which an instance is unhealthy")
+	sdCmd.Flags().DurationVar(&healthCooldown, "health.cooldown", 30*time.Second, "how long an instance stays unhealthy")
+	sdCmd.Flags().BoolVar(&healthExclude, "health.exclude", false, "drop unhealthy instances instead of returning them last")
+	sdCmd.Flags().StringVar(&sdAdminAddr, "admin.addr", "", "admin HTTP API address, empty to disable")
+	sdCmd.Flags().StringVar(&sdAdminToken, "admin.token", "", "admin HTTP API bearer token, empty for no authentication")
 
 	recorderCmd := &cobra.Command{
 		Use:   "recorder",
@@ -168,5 +291,45 @@ func init() {
 	limiterCmd.Flags().IntVar(&limitIn, "limiter.in", 1048576, "input traffic limit")
 	limiterCmd.Flags().IntVar(&limitOut, "limiter.out", 1048576, "output traffic limit")
 
-	rootCmd.AddCommand(ingressCmd, sdCmd, recorderCmd, limiterCmd)
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrate redis keys",
+		Long:  "Move the redis keys of the ingress or sd plugin from the unprefixed layout into a namespace",
+	}
+	migrateIngressCmd := &cobra.Command{
+		Use:   "ingress",
+		Short: "Migrate ingress rules",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ingress.Migrate(cmd.Context(), &ingress.Options{
+				RedisAddr:     migrateRedisAddr,
+				RedisDB:       redisDB,
+				RedisUsername: redisUsername,
+				RedisPassword: redisPassword,
+				Namespace:     redisNamespace,
+			}, dryRun)
+		},
+	}
+	migrateSDCmd := &cobra.Command{
+		Use:   "sd",
+		Short: "Migrate sd services",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return sd.Migrate(cmd.Context(), &sd.Options{
+				RedisAddr:     migrateRedisAddr,
+				RedisDB:       redisDB,
+				RedisUsername: redisUsername,
+				RedisPassword: redisPassword,
+				Namespace:     redisNamespace,
+			}, dryRun)
+		},
+	}
+	migrateCmd.PersistentFlags().StringVar(&migrateRedisAddr, "redis.addr", "127.0.0.1:6379", "redis server address")
+	migrateCmd.PersistentFlags().IntVar(&redisDB, "redis.db", 0, "redis database")
+	migrateCmd.PersistentFlags().StringVar(&redisUsername, "redis.username", "", "redis username")
+	migrateCmd.PersistentFlags().StringVar(&redisPassword, "redis.password", "", "redis password")
+	migrateCmd.PersistentFlags().StringVar(&redisNamespace, "redis.namespace", "", "redis key namespace to move the keys into")
+	migrateCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "only log the keys to move")
+	migrateCmd.MarkPersistentFlagRequired("redis.namespace")
+	migrateCmd.AddCommand(migrateIngressCmd, migrateSDCmd)
+
+	rootCmd.AddCommand(ingressCmd, sdCmd, recorderCmd, limiterCmd, migrateCmd)
 }
@@ -0,0 +1,286 @@
+package ingress
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/ginuerzh/gost-plugins/internal/util"
+)
+
+type adminTransferRequest struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Force bool   `json:"force"`
+}
+
+type adminMemberRequest struct {
+	Weight   int    `json:"weight"`
+	Strategy string `json:"strategy"`
+}
+
+type adminStatsReply struct {
+	Cache *CacheStats `json:"cache,omitempty"`
+}
+
+type adminListReply struct {
+	Rules []RuleInfo `json:"rules"`
+	// cursor of the next page, "0" when the listing is complete
+	Cursor string `json:"cursor"`
+}
+
+type adminReply struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// adminServer exposes rule management over HTTP:
+//
+//	GET    /rules?prefix=<p>&tunnel=<id>&cursor=<c>&count=<n>   list rules
+//	GET    /rules/{host}                                 show a rule
+//	DELETE /rules/{host}?tunnel=<id>                     release a rule owned by the tunnel
+//	POST   /rules/{host}/transfer                        hand a rule over to another tunnel
+//	PUT    /rules/{host}/members/{tunnel}?owner=<id>     add a member tunnel serving the host
+//	DELETE /rules/{host}/members/{tunnel}?owner=<id>     remove a member tunnel
+//	GET    /stats                                        cache counters
+//
+// With Options.AdminToken set, listings must carry it (Authorization: Bearer <token>).
+// Requests carrying it may release any rule, force a transfer and manage members
+// regardless of the current owner, which is only served with Options.AdminToken set.
+type adminServer struct {
+	srv *server
+}
+
+func listenAndServeAdmin(addr string, srv *server) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("admin server listening on %v", ln.Addr()))
+
+	s := &adminServer{srv: srv}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rules", s.list)
+	mux.HandleFunc("GET /rules/{host}", s.get)
+	mux.HandleFunc("DELETE /rules/{host}", s.release)
+	mux.HandleFunc("POST /rules/{host}/transfer", s.transfer)
+	mux.HandleFunc("PUT /rules/{host}/members/{tunnel}", s.addMember)
+	mux.HandleFunc("DELETE /rules/{host}/members/{tunnel}", s.removeMember)
+	mux.HandleFunc("GET /stats", s.stats)
+
+	return (&http.Server{Handler: mux}).Serve(ln)
+}
+
+func (s *adminServer) isAdmin(r *http.Request) bool {
+	return util.IsAdmin(r, s.srv.opts.AdminToken)
+}
+
+// hostKey returns the rule key of the host in the request path and the domain it is under.
+// Path rules are addressed with an escaped slash, e.g. /rules/foo.gost.run%2Fapi.
+func (s *adminServer) hostKey(w http.ResponseWriter, r *http.Request) (key, domain string, ok bool) {
+	host, prefix := splitPath(r.PathValue("host"))
+	host, err := normalizeHost(host)
+	if err != nil {
+		writeAdminReply(w, http.StatusBadRequest, err)
+		return "", "", false
+	}
+	key, domain = s.srv.ruleKey(host)
+	return key + prefix, domain, true
+}
+
+func (s *adminServer) list(w http.ResponseWriter, r *http.Request) {
+	if !util.Authorized(r, s.srv.opts.AdminToken) {
+		writeAdminReply(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+		return
+	}
+
+	q := r.URL.Query()
+	cursor, err := strconv.ParseUint(cmp.Or(q.Get("cursor"), "0"), 10, 64)
+	if err != nil {
+		writeAdminReply(w, http.StatusBadRequest, fmt.Errorf("invalid cursor: %w", err))
+		return
+	}
+	count, err := strconv.ParseInt(cmp.Or(q.Get("count"), "100"), 10, 64)
+	if err != nil || count <= 0 || count > 1000 {
+		writeAdminReply(w, http.StatusBadRequest, errors.New("invalid count, must be 1-1000"))
+		return
+	}
+	prefix := q.Get("prefix")
+
+	var rules []RuleInfo
+	var next uint64
+	if v := q.Get("tunnel"); v != "" {
+		t := newTunnel(parseTunnelID(v))
+		if t.IsZero() {
+			writeAdminReply(w, http.StatusBadRequest, errors.New("invalid tunnel ID"))
+			return
+		}
+		rules, next, err = s.srv.listTunnelRules(r.Context(), t, cursor, count, prefix)
+	} else {
+		rules, next, err = s.srv.listRules(r.Context(), cursor, count, prefix)
+	}
+	if err != nil {
+		writeAdminReply(w, http.StatusOK, err)
+		return
+	}
+
+	if rules == nil {
+		rules = []RuleInfo{}
+	}
+	util.WriteJSON(w, http.StatusOK, adminListReply{
+		Rules:  rules,
+		Cursor: strconv.FormatUint(next, 10),
+	})
+}
+
+func (s *adminServer) get(w http.ResponseWriter, r *http.Request) {
+	if !util.Authorized(r, s.srv.opts.AdminToken) {
+		writeAdminReply(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+		return
+	}
+
+	key, _, ok := s.hostKey(w, r)
+	if !ok {
+		return
+	}
+	rules, err := s.srv.ruleInfos(r.Context(), []string{key})
+	if err == nil && len(rules) == 0 {
+		err = ErrRuleNotFound
+	}
+	if err != nil {
+		writeAdminReply(w, http.StatusOK, err)
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, rules[0])
+}
+
+func (s *adminServer) release(w http.ResponseWriter, r *http.Request) {
+	key, _, ok := s.hostKey(w, r)
+	if !ok {
+		return
+	}
+
+	t := newTunnel(parseTunnelID(r.URL.Query().Get("tunnel")))
+	if t.IsZero() && !s.isAdmin(r) {
+		writeAdminReply(w, http.StatusForbidden, errors.New("tunnel ID or admin token required"))
+		return
+	}
+
+	writeAdminReply(w, http.StatusOK, s.srv.release(r.Context(), key, t))
+}
+
+func (s *adminServer) transfer(w http.ResponseWriter, r *http.Request) {
+	key, domain, ok := s.hostKey(w, r)
+	if !ok {
+		return
+	}
+
+	var req adminTransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminReply(w, http.StatusBadRequest, err)
+		return
+	}
+
+	to := newTunnel(parseTunnelID(req.To))
+	if to.IsZero() {
+		writeAdminReply(w, http.StatusBadRequest, errors.New("invalid target tunnel ID"))
+		return
+	}
+
+	var from tunnel
+	if req.Force {
+		if !s.isAdmin(r) {
+			writeAdminReply(w, http.StatusForbidden, errors.New("admin token required"))
+			return
+		}
+	} else if from = newTunnel(parseTunnelID(req.From)); from.IsZero() {
+		writeAdminReply(w, http.StatusBadRequest, errors.New("invalid source tunnel ID"))
+		return
+	}
+
+	writeAdminReply(w, http.StatusOK, s.srv.transfer(r.Context(), key, domain, from, to, req.Force))
+}
+
+// memberArgs parses the rule key, member tunnel and owner of a member request.
+func (s *adminServer) memberArgs(w http.ResponseWriter, r *http.Request) (key string, m, owner tunnel, ok bool) {
+	if key, _, ok = s.hostKey(w, r); !ok {
+		return
+	}
+
+	if m = newTunnel(parseTunnelID(r.PathValue("tunnel"))); m.IsZero() {
+		writeAdminReply(w, http.StatusBadRequest, errors.New("invalid member tunnel ID"))
+		return key, m, owner, false
+	}
+	owner = newTunnel(parseTunnelID(r.URL.Query().Get("owner")))
+	if owner.IsZero() && !s.isAdmin(r) {
+		writeAdminReply(w, http.StatusForbidden, errors.New("owner tunnel ID or admin token required"))
+		return key, m, owner, false
+	}
+
+	return key, m, owner, true
+}
+
+func (s *adminServer) addMember(w http.ResponseWriter, r *http.Request) {
+	key, t, owner, ok := s.memberArgs(w, r)
+	if !ok {
+		return
+	}
+
+	var req adminMemberRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminReply(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	m := member{Tunnel: t, Weight: req.Weight}
+	writeAdminReply(w, http.StatusOK, s.srv.addMember(r.Context(), key, owner, m, req.Strategy))
+}
+
+func (s *adminServer) removeMember(w http.ResponseWriter, r *http.Request) {
+	key, t, owner, ok := s.memberArgs(w, r)
+	if !ok {
+		return
+	}
+
+	writeAdminReply(w, http.StatusOK, s.srv.removeMember(r.Context(), key, owner, t))
+}
+
+func (s *adminServer) stats(w http.ResponseWriter, r *http.Request) {
+	util.WriteJSON(w, http.StatusOK, adminStatsReply{
+		Cache: s.srv.cache.stats(),
+	})
+}
+
+// writeAdminReply writes the result of an admin operation,
+// mapping rule errors to the corresponding HTTP status.
+func writeAdminReply(w http.ResponseWriter, code int, err error) {
+	reply := adminReply{Ok: err == nil}
+	if err != nil {
+		reply.Error = err.Error()
+		switch {
+		case code != http.StatusOK:
+		case errors.Is(err, ErrRuleOwned), errors.Is(err, ErrRuleDomain):
+			code = http.StatusConflict
+		case errors.Is(err, ErrRuleNotFound), errors.Is(err, ErrNotMember):
+			code = http.StatusNotFound
+		case errors.Is(err, ErrQuotaExceeded):
+			code = http.StatusTooManyRequests
+		case errors.Is(err, ErrInvalidStrategy):
+			code = http.StatusBadRequest
+		default:
+			slog.Error(fmt.Sprintf("admin: %v", err))
+			code = http.StatusInternalServerError
+		}
+	}
+
+	util.WriteJSON(w, code, reply)
+}
@@ -0,0 +1,176 @@
+package ingress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	AllocWord = "word"
+	AllocSlug = "slug"
+
+	defaultAllocLength   = 8
+	defaultAllocAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+	// attempts to find a free name before giving up
+	allocAttempts = 16
+
+	// gRPC response header carrying the allocated host name
+	allocHostHeader = "host"
+)
+
+var (
+	// ErrAllocExhausted is returned when no free host name could be allocated.
+	ErrAllocExhausted = errors.New("no free host name available")
+	// ErrInvalidAlphabet is returned for an allocation alphabet that can not form host names.
+	ErrInvalidAlphabet = errors.New("invalid alloc alphabet")
+)
+
+var (
+	allocAdjectives = []string{
+		"amber", "ancient", "bold", "brave", "bright", "calm", "clever", "cosmic",
+		"crisp", "curious", "daring", "eager", "fancy", "fierce", "gentle", "giant",
+		"golden", "grand", "happy", "hidden", "humble", "icy", "jolly", "keen",
+		"lively", "lucky", "mellow", "merry", "mighty", "misty", "noble", "odd",
+		"polite", "proud", "quick", "quiet", "rapid", "royal", "rusty", "shiny",
+		"silent", "silver", "sleepy", "smooth", "snowy", "solar", "spicy", "steady",
+		"sunny", "swift", "tidy", "tiny", "vivid", "warm", "wild", "windy",
+		"wise", "witty", "young", "zesty", "azure", "crimson", "dusty", "frosty",
+	}
+	allocNouns = []string{
+		"badger", "bear", "beaver", "bison", "cobra", "comet", "condor", "coral",
+		"crane", "falcon", "ferret", "finch", "fox", "gecko", "glacier", "hawk",
+		"heron", "ibis", "jaguar", "koala", "lemur", "lion", "lynx", "meadow",
+		"meteor", "moose", "moth", "nebula", "newt", "ocean", "orca", "otter",
+		"owl", "panda", "parrot", "pebble", "pine", "planet", "puma", "quail",
+		"raven", "reef", "river", "robin", "salmon", "seal", "shark", "sparrow",
+		"spruce", "squid", "stone", "swan", "tiger", "toucan", "trout", "tulip",
+		"turtle", "valley", "walrus", "whale", "willow", "wolf", "yak", "zebra",
+	}
+)
+
+// checkAlphabet reports whether the characters of alphabet are valid in host
+// names: lowercase letters, digits and '-', with at least one letter or digit
+// since generated names may not begin or end with '-'.
+func checkAlphabet(alphabet string) error {
+	alnum := false
+	for _, c := range alphabet {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+			alnum = true
+		case c == '-':
+		default:
+			return fmt.Errorf("%w: %q is not a lowercase letter, digit or '-'", ErrInvalidAlphabet, c)
+		}
+	}
+	if !alnum {
+		return fmt.Errorf("%w: no letters or digits", ErrInvalidAlphabet)
+	}
+	return nil
+}
+
+// allocName generates a candidate host name under a domain with the settings ds
+// according to Options.AllocMode. Word names get a numeric suffix after the first
+// attempts to widen the space; those that do not fit the length bounds or charset
+// of the domain fall back to slugs, which are fitted into them.
+func (s *server) allocName(attempt int, ds *domainSettings) string {
+	if s.opts.AllocMode == AllocWord {
+		name := allocAdjectives[rand.IntN(len(allocAdjectives))] + "-" + allocNouns[rand.IntN(len(allocNouns))]
+		if attempt >= allocAttempts/2 {
+			name = fmt.Sprintf("%s-%d", name, rand.IntN(1000))
+		}
+		if len(name) >= ds.min && ds.check(name) == nil {
+			return name
+		}
+	}
+
+	n := s.opts.AllocLength
+	if n <= 0 {
+		n = defaultAllocLength
+	}
+	if ds.max > 0 {
+		n = min(n, ds.max)
+	}
+	n = max(n, ds.min)
+
+	// only the characters allowed by the domain; '-' neither first nor last.
+	alphabet := s.opts.AllocAlphabet
+	if alphabet == "" {
+		alphabet = defaultAllocAlphabet
+	}
+	var chars, edge []rune
+	for _, c := range alphabet {
+		if ds.charset != nil && !ds.charset.MatchString(string(c)) {
+			continue
+		}
+		chars = append(chars, c)
+		if c != '-' {
+			edge = append(edge, c)
+		}
+	}
+	if len(edge) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		set := chars
+		if i == 0 || i == n-1 {
+			set = edge
+		}
+		b.WriteRune(set[rand.IntN(len(set))])
+	}
+	return b.String()
+}
+
+// allocate reserves a free generated name under domain for the rule r
+// and returns the full host name.
+func (s *server) allocate(ctx context.Context, domain string, r *rule) (string, error) {
+	ds := s.domains.get(domain)
+	for i := 0; i < allocAttempts; i++ {
+		key := s.allocName(i, ds)
+		if key == "" || len(key) < ds.min || ds.check(key) != nil {
+			continue
+		}
+		if err := s.policy.get().check(key, r.Tunnel); err != nil {
+			continue
+		}
+
+		rk := s.domainKey(key, domain)
+		if rk != key && s.checkLegacyRule(ctx, key, r.Tunnel) != nil {
+			continue
+		}
+		ok, err := s.insertRule(ctx, rk, r, ds.ttl)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		s.touch(ctx, rk)
+		s.publish(ctx, EventClaim, rk, r, r.Tunnel)
+
+		host := key
+		if domain != "" {
+			host = key + "." + domain
+		}
+		slog.Info(fmt.Sprintf("allocate: %s -> %s", host, r.Tunnel))
+		return host, nil
+	}
+
+	return "", ErrAllocExhausted
+}
+
+// setAllocHeader returns the allocated host to the caller in the gRPC response header.
+func setAllocHeader(ctx context.Context, host string) {
+	if err := grpc.SetHeader(ctx, metadata.Pairs(allocHostHeader, host)); err != nil {
+		slog.Debug(fmt.Sprintf("allocate: %v", err))
+	}
+}
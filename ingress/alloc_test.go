@@ -0,0 +1,61 @@
+package ingress
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCheckAlphabet(t *testing.T) {
+	tests := []struct {
+		alphabet string
+		valid    bool
+	}{
+		{"abcdefghijklmnopqrstuvwxyz0123456789", true},
+		{"abc-", true},
+		{"0123456789", true},
+		{"ABC", false},
+		{"abc_", false},
+		{"abc.", false},
+		{"ä", false},
+		{"-", false},
+	}
+	for _, tt := range tests {
+		err := checkAlphabet(tt.alphabet)
+		if tt.valid && err != nil {
+			t.Errorf("checkAlphabet(%q) = %v, want nil", tt.alphabet, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidAlphabet) {
+			t.Errorf("checkAlphabet(%q) = %v, want ErrInvalidAlphabet", tt.alphabet, err)
+		}
+	}
+}
+
+func TestAllocName(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		ds   domainSettings
+	}{
+		{"slug", Options{AllocAlphabet: "ab-"}, domainSettings{}},
+		{"slug max", Options{AllocLength: 12}, domainSettings{max: 6}},
+		{"slug min", Options{AllocLength: 2}, domainSettings{min: 5}},
+		{"slug charset", Options{}, domainSettings{charset: regexp.MustCompile("^[a-f]+$")}},
+		{"word", Options{AllocMode: AllocWord}, domainSettings{}},
+		{"word max", Options{AllocMode: AllocWord}, domainSettings{max: 4}},
+		{"word charset", Options{AllocMode: AllocWord}, domainSettings{charset: regexp.MustCompile("^[a-z]+$")}},
+	}
+	for _, tt := range tests {
+		s := &server{opts: &tt.opts}
+		for i := 0; i < 100; i++ {
+			name := s.allocName(i%allocAttempts, &tt.ds)
+			if len(name) < tt.ds.min || tt.ds.check(name) != nil {
+				t.Fatalf("%s: allocName = %q, does not fit the domain", tt.name, name)
+			}
+			if strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") {
+				t.Fatalf("%s: allocName = %q, begins or ends with '-'", tt.name, name)
+			}
+		}
+	}
+}
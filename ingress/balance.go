@@ -0,0 +1,194 @@
+package ingress
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Strategies to select one of the members serving a host.
+const (
+	BalanceRoundRobin = "round"
+	BalanceRandom     = "random"
+	BalanceHash       = "hash"
+)
+
+var (
+	// ErrInvalidStrategy is returned for an unknown balance strategy.
+	ErrInvalidStrategy = errors.New("invalid balance strategy")
+)
+
+// member is one of the tunnels serving a host.
+type member struct {
+	Tunnel tunnel `json:"tunnel"`
+	Weight int    `json:"weight,omitempty"`
+	// last time the tunnel refreshed its registration
+	Renew int64 `json:"renew,omitempty"`
+}
+
+func (m *member) weight() int {
+	if m.Weight <= 0 {
+		return 1
+	}
+	return m.Weight
+}
+
+func validStrategy(strategy string) bool {
+	switch strategy {
+	case "", BalanceRoundRobin, BalanceRandom, BalanceHash:
+		return true
+	default:
+		return false
+	}
+}
+
+// member returns the member entry of the tunnel t, nil if t is not a member.
+func (r *rule) member(t tunnel) *member {
+	for i := range r.Members {
+		if r.Members[i].Tunnel.Equal(t) {
+			return &r.Members[i]
+		}
+	}
+	return nil
+}
+
+// serves reports whether the tunnel t owns or is a member of r.
+func (r *rule) serves(t tunnel) bool {
+	return r.Tunnel.Equal(t) || r.member(t) != nil
+}
+
+// live returns the members whose registrations have not lapsed.
+// A rule without members is served by its owner alone.
+func (r *rule) live(expiration time.Duration) []member {
+	if len(r.Members) == 0 {
+		return []member{{Tunnel: r.Tunnel}}
+	}
+
+	deadline := time.Now().Add(-expiration).Unix()
+	var members []member
+	for _, m := range r.Members {
+		if expiration <= 0 || m.Renew >= deadline {
+			members = append(members, m)
+		}
+	}
+	return members
+}
+
+// prune drops the lapsed members other than the owner and returns them.
+func (r *rule) prune(expiration time.Duration) (lapsed []member) {
+	if expiration <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(-expiration).Unix()
+	r.Members = slices.DeleteFunc(r.Members, func(m member) bool {
+		if m.Renew < deadline && !m.Tunnel.Equal(r.Tunnel) {
+			lapsed = append(lapsed, m)
+			return true
+		}
+		return false
+	})
+	return
+}
+
+// balancer selects a member of a rule for each lookup.
+type balancer struct {
+	// round-robin counters by rule key
+	counters sync.Map
+}
+
+func (b *balancer) pick(ctx context.Context, key, strategy string, members []member) (tunnel, bool) {
+	switch len(members) {
+	case 0:
+		return tunnel{}, false
+	case 1:
+		return members[0].Tunnel, true
+	}
+
+	total := 0
+	for i := range members {
+		total += members[i].weight()
+	}
+
+	switch strategy {
+	case BalanceRandom:
+		return pickWeighted(members, rand.IntN(total)), true
+	case BalanceHash:
+		return pickHash(clientKey(ctx), members), true
+	default:
+		v, _ := b.counters.LoadOrStore(key, &atomic.Uint64{})
+		n := v.(*atomic.Uint64).Add(1) - 1
+		return pickWeighted(members, int(n%uint64(total))), true
+	}
+}
+
+// forget drops the round-robin counter of the rule key, once the rule is gone.
+func (b *balancer) forget(key string) {
+	b.counters.Delete(key)
+}
+
+// pickWeighted returns the member covering the point n of the cumulative weights.
+func pickWeighted(members []member, n int) tunnel {
+	for i := range members {
+		if n -= members[i].weight(); n < 0 {
+			return members[i].Tunnel
+		}
+	}
+	return members[len(members)-1].Tunnel
+}
+
+// pickHash selects a member by weighted rendezvous hashing on the client,
+// so a client sticks to the same member as long as the member set is stable.
+func pickHash(client string, members []member) tunnel {
+	var best tunnel
+	bestScore := math.Inf(-1)
+	for i := range members {
+		h := fnv.New64a()
+		h.Write([]byte(client))
+		h.Write([]byte(members[i].Tunnel.ID))
+		// map the hash into (0, 1)
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		if score := float64(members[i].weight()) / -math.Log(u); score > bestScore {
+			best, bestScore = members[i].Tunnel, score
+		}
+	}
+	return best
+}
+
+// clientKeyMetadata are the request metadata fields identifying the client of a lookup,
+// in order of preference.
+var clientKeyMetadata = []string{"client", "x-real-ip", "x-forwarded-for"}
+
+// clientKey identifies the client of a lookup for hash balancing: the first of the
+// clientKeyMetadata the caller supplies, the peer address otherwise. GOST itself sends
+// none of them, so without a proxy adding them the peer is the gateway and all clients
+// behind one gateway stick to the same member.
+func clientKey(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, k := range clientKeyMetadata {
+			if v := md.Get(k); len(v) > 0 && v[0] != "" {
+				// the original client of a forwarding chain
+				client, _, _ := strings.Cut(v[0], ",")
+				return strings.TrimSpace(client)
+			}
+		}
+	}
+	if p, _ := peer.FromContext(ctx); p != nil && p.Addr != nil {
+		host := p.Addr.String()
+		if h, _, _ := net.SplitHostPort(host); h != "" {
+			host = h
+		}
+		return host
+	}
+	return ""
+}
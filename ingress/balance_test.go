@@ -0,0 +1,120 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestPickWeighted(t *testing.T) {
+	members := []member{
+		{Tunnel: tunnel{ID: "a"}, Weight: 2},
+		{Tunnel: tunnel{ID: "b"}},
+		{Tunnel: tunnel{ID: "c"}, Weight: 3},
+	}
+
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "a"},
+		{1, "a"},
+		{2, "b"},
+		{3, "c"},
+		{5, "c"},
+		// beyond the total weight
+		{6, "c"},
+	}
+	for _, tt := range tests {
+		if got := pickWeighted(members, tt.n); got.ID != tt.want {
+			t.Errorf("pickWeighted(%d) = %s, want %s", tt.n, got.ID, tt.want)
+		}
+	}
+}
+
+func TestPickHash(t *testing.T) {
+	members := []member{
+		{Tunnel: tunnel{ID: "a"}},
+		{Tunnel: tunnel{ID: "b"}},
+		{Tunnel: tunnel{ID: "c"}},
+	}
+
+	t.Run("stable", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			client := fmt.Sprintf("10.0.0.%d", i)
+			first := pickHash(client, members)
+			if got := pickHash(client, members); got.ID != first.ID {
+				t.Fatalf("pickHash(%q) = %s, then %s", client, first.ID, got.ID)
+			}
+			// clients of a removed member move, the others stay.
+			if first.ID != "c" {
+				if got := pickHash(client, members[:2]); got.ID != first.ID {
+					t.Fatalf("pickHash(%q) without c = %s, want %s", client, got.ID, first.ID)
+				}
+			}
+		}
+	})
+
+	t.Run("weights", func(t *testing.T) {
+		weighted := []member{
+			{Tunnel: tunnel{ID: "heavy"}, Weight: 9},
+			{Tunnel: tunnel{ID: "light"}, Weight: 1},
+		}
+		const runs = 10000
+		heavy := 0
+		for i := 0; i < runs; i++ {
+			if pickHash(fmt.Sprintf("client-%d", i), weighted).ID == "heavy" {
+				heavy++
+			}
+		}
+		// the heavy member serves 9/10 of the clients.
+		if p := float64(heavy) / runs; p < 0.85 || p > 0.95 {
+			t.Errorf("pickHash: heavy member picked for %.3f of clients, want about 0.9", p)
+		}
+	})
+}
+
+func TestClientKey(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4321}
+
+	tests := []struct {
+		md   metadata.MD
+		want string
+	}{
+		{nil, "192.0.2.1"},
+		{metadata.Pairs("client", "alice"), "alice"},
+		{metadata.Pairs("x-real-ip", "198.51.100.7"), "198.51.100.7"},
+		{metadata.Pairs("x-forwarded-for", "198.51.100.7, 203.0.113.1"), "198.51.100.7"},
+		{metadata.Pairs("client", "alice", "x-real-ip", "198.51.100.7"), "alice"},
+		{metadata.Pairs("client", ""), "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+		if tt.md != nil {
+			ctx = metadata.NewIncomingContext(ctx, tt.md)
+		}
+		if got := clientKey(ctx); got != tt.want {
+			t.Errorf("clientKey(%v) = %q, want %q", tt.md, got, tt.want)
+		}
+	}
+}
+
+func TestBalancerForget(t *testing.T) {
+	var b balancer
+	members := []member{{Tunnel: tunnel{ID: "a"}}, {Tunnel: tunnel{ID: "b"}}}
+
+	if got, _ := b.pick(context.Background(), "foo", BalanceRoundRobin, members); got.ID != "a" {
+		t.Fatalf("pick = %s, want a", got.ID)
+	}
+	b.forget("foo")
+	if _, ok := b.counters.Load("foo"); ok {
+		t.Fatal("counter of foo kept after forget")
+	}
+	if got, _ := b.pick(context.Background(), "foo", BalanceRoundRobin, members); got.ID != "a" {
+		t.Errorf("pick after forget = %s, want a", got.ID)
+	}
+}
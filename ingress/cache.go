@@ -0,0 +1,192 @@
+package ingress
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ruleCache is a bounded LRU cache of rules by rule key. Missing rules are
+// cached as well (negative entries) with their own, usually shorter, TTL.
+type ruleCache struct {
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+
+	hits      atomic.Uint64
+	negatives atomic.Uint64
+	misses    atomic.Uint64
+}
+
+type cacheEntry struct {
+	key     string
+	rule    *rule
+	expires time.Time
+}
+
+// CacheStats are the counters of the GetRule cache.
+type CacheStats struct {
+	Size int `json:"size"`
+	// lookups answered by cached rules
+	Hits uint64 `json:"hits"`
+	// lookups answered by cached missing rules only
+	NegativeHits uint64 `json:"negativeHits"`
+	// lookups fetching any of their rules from Redis
+	Misses uint64 `json:"misses"`
+}
+
+func newRuleCache(size int, ttl, negativeTTL time.Duration) *ruleCache {
+	if size <= 0 {
+		return nil
+	}
+	return &ruleCache{
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		ll:          list.New(),
+		items:       make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached rule of key, nil for a cached missing rule.
+// ok is false if key is not cached.
+func (c *ruleCache) get(key string) (r *rule, ok bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el := c.items[key]
+	if el == nil {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	return e.rule, true
+}
+
+// record counts a lookup of the candidate rules of a host, missed if any of them
+// was not cached.
+func (c *ruleCache) record(rules []*rule, missed bool) {
+	if c == nil {
+		return
+	}
+
+	switch {
+	case missed:
+		c.misses.Add(1)
+	case slices.ContainsFunc(rules, func(r *rule) bool { return r != nil }):
+		c.hits.Add(1)
+	default:
+		c.negatives.Add(1)
+	}
+}
+
+// set caches the rule of key, a nil r caches a missing rule.
+func (c *ruleCache) set(key string, r *rule) {
+	if c == nil {
+		return
+	}
+
+	ttl := c.ttl
+	if r == nil {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &cacheEntry{key: key, rule: r, expires: time.Now().Add(ttl)}
+	if el := c.items[key]; el != nil {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(e)
+
+	for c.ll.Len() > c.size {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *ruleCache) remove(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el := c.items[key]; el != nil {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+func (c *ruleCache) stats() *CacheStats {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	n := c.ll.Len()
+	c.mu.Unlock()
+
+	return &CacheStats{
+		Size:         n,
+		Hits:         c.hits.Load(),
+		NegativeHits: c.negatives.Load(),
+		Misses:       c.misses.Load(),
+	}
+}
+
+// watchEvents drops cached rules changed by any of the ingress replicas, and the
+// balance state of the rules they removed, as announced on the event channel.
+func (s *server) watchEvents(ctx context.Context) {
+	pubsub := s.client.Subscribe(ctx, s.opts.EventChannel)
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var ev Event
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+				slog.Warn(fmt.Sprintf("event: %v", err))
+				continue
+			}
+			s.cache.remove(ev.Key)
+			if removed(ev.Action) {
+				s.balancer.forget(ev.Key)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package ingress
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleCache(t *testing.T) {
+	foo := &rule{Tunnel: tunnel{ID: "foo"}}
+
+	tests := []struct {
+		name string
+		// operations on a cache of size 2: "set k", "miss k" (a cached missing rule),
+		// "get k", "remove k" and "wait" past the negative TTL
+		ops []string
+		// cached keys afterwards, with a nil rule for missing rules
+		cached map[string]bool
+	}{
+		{"set", []string{"set a"}, map[string]bool{"a": true}},
+		{"negative", []string{"miss a"}, map[string]bool{"a": false}},
+		{"replace", []string{"miss a", "set a"}, map[string]bool{"a": true}},
+		{"evict", []string{"set a", "set b", "set c"}, map[string]bool{"b": true, "c": true}},
+		{"evict lru", []string{"set a", "set b", "get a", "set c"}, map[string]bool{"a": true, "c": true}},
+		{"remove", []string{"set a", "set b", "remove a"}, map[string]bool{"b": true}},
+		{"remove missing", []string{"set a", "remove b"}, map[string]bool{"a": true}},
+		{"negative ttl", []string{"set a", "miss b", "wait"}, map[string]bool{"a": true}},
+	}
+	for _, tt := range tests {
+		c := newRuleCache(2, time.Minute, 20*time.Millisecond)
+		for _, op := range tt.ops {
+			switch op, key, _ := strings.Cut(op, " "); op {
+			case "set":
+				c.set(key, foo)
+			case "miss":
+				c.set(key, nil)
+			case "get":
+				c.get(key)
+			case "remove":
+				c.remove(key)
+			case "wait":
+				time.Sleep(30 * time.Millisecond)
+			}
+		}
+		for _, key := range []string{"a", "b", "c"} {
+			r, ok := c.get(key)
+			found, want := tt.cached[key]
+			if ok != want || ok && (r != nil) != found {
+				t.Errorf("%s: get(%q) = %v, %v, want cached %v with rule %v", tt.name, key, r, ok, want, found)
+			}
+		}
+	}
+}
+
+func TestRuleCacheDisabled(t *testing.T) {
+	if c := newRuleCache(0, time.Minute, time.Minute); c != nil {
+		t.Fatal("newRuleCache(0) returned a cache")
+	}
+	var c *ruleCache
+	c.set("a", &rule{})
+	c.remove("a")
+	c.record(nil, true)
+	if _, ok := c.get("a"); ok {
+		t.Error("get on a nil cache succeeded")
+	}
+	if c.stats() != nil {
+		t.Error("stats of a nil cache")
+	}
+
+	// a zero TTL disables caching of that kind of entry.
+	c = newRuleCache(2, time.Minute, 0)
+	c.set("a", nil)
+	if _, ok := c.get("a"); ok {
+		t.Error("missing rule cached with a zero negative TTL")
+	}
+}
+
+func TestRuleCacheStats(t *testing.T) {
+	foo := &rule{Tunnel: tunnel{ID: "foo"}}
+	c := newRuleCache(8, time.Minute, time.Minute)
+
+	// lookups of several candidate keys count once each.
+	c.record([]*rule{nil, nil, nil}, true)
+	c.record([]*rule{nil, foo, nil}, false)
+	c.record([]*rule{nil, nil}, false)
+	c.record([]*rule{foo, nil}, true)
+	c.set("a", foo)
+
+	want := CacheStats{Size: 1, Hits: 1, NegativeHits: 1, Misses: 2}
+	if got := c.stats(); *got != want {
+		t.Errorf("stats() = %+v, want %+v", *got, want)
+	}
+}
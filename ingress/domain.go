@@ -0,0 +1,195 @@
+package ingress
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrHostInvalid is returned for a malformed host name or one breaking the rules of its domain.
+	ErrHostInvalid = errors.New("invalid host name")
+	// ErrCustomDenied is returned when a domain only serves generated host names.
+	ErrCustomDenied = errors.New("custom host names are not allowed")
+	// ErrPrivateDenied is returned when a domain does not serve private tunnels.
+	ErrPrivateDenied = errors.New("private tunnels are not allowed")
+)
+
+// domainConfig is the JSON layout of one domain in the domain file,
+// which maps domain names to their settings:
+//
+//	{
+//	  "gost.run": {"min": 4, "max": 32, "charset": "a-z0-9-", "ttl": "2h"},
+//	  "tmp.gost.run": {"custom": false, "private": false, "ttl": "10m"}
+//	}
+//
+// Min and max bound the length of the host prefix, charset is the content of a
+// regular expression character class the prefix labels must consist of. Custom
+// set to false only serves generated names, private set to false rejects
+// private tunnels. Unset settings fall back to Options.MinDomain and
+// Options.RedisExpiration, no maximum length and any character.
+type domainConfig struct {
+	Min     int    `json:"min"`
+	Max     int    `json:"max"`
+	Charset string `json:"charset"`
+	TTL     string `json:"ttl"`
+	Custom  *bool  `json:"custom"`
+	Private *bool  `json:"private"`
+}
+
+type domainSettings struct {
+	min     int
+	max     int
+	charset *regexp.Regexp
+	ttl     time.Duration
+	custom  bool
+	private bool
+}
+
+// domains holds the settings of the domains listed in Options.DomainFile.
+// Other domains, and hosts outside of all domains, use the fallback settings.
+type domains struct {
+	settings map[string]*domainSettings
+	fallback *domainSettings
+}
+
+func newDomains(opts *Options) (*domains, error) {
+	d := &domains{
+		settings: make(map[string]*domainSettings),
+		fallback: &domainSettings{
+			min:     opts.MinDomain,
+			ttl:     opts.RedisExpiration,
+			custom:  true,
+			private: true,
+		},
+	}
+	if opts.DomainFile == "" {
+		return d, nil
+	}
+
+	data, err := os.ReadFile(opts.DomainFile)
+	if err != nil {
+		return nil, err
+	}
+	var cfg map[string]*domainConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	for name, c := range cfg {
+		names, err := normalizeDomains([]string{name})
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 || c == nil {
+			continue
+		}
+		ds, err := d.parse(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		d.settings[names[0]] = ds
+	}
+
+	return d, nil
+}
+
+func (d *domains) parse(c *domainConfig) (*domainSettings, error) {
+	ds := *d.fallback
+	if c.Min > 0 {
+		ds.min = c.Min
+	}
+	if c.Max > 0 {
+		if c.Max < ds.min {
+			return nil, fmt.Errorf("max %d is less than min %d", c.Max, ds.min)
+		}
+		ds.max = c.Max
+	}
+	if c.Charset != "" {
+		re, err := regexp.Compile("^[" + c.Charset + "]+$")
+		if err != nil {
+			return nil, fmt.Errorf("charset: %w", err)
+		}
+		ds.charset = re
+	}
+	if c.TTL != "" {
+		ttl, err := time.ParseDuration(c.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("ttl: %w", err)
+		}
+		ds.ttl = ttl
+	}
+	if c.Custom != nil {
+		ds.custom = *c.Custom
+	}
+	if c.Private != nil {
+		ds.private = *c.Private
+	}
+	return &ds, nil
+}
+
+// get returns the settings of domain, the fallback settings if it has none.
+func (d *domains) get(domain string) *domainSettings {
+	if ds, ok := d.settings[domain]; ok {
+		return ds
+	}
+	return d.fallback
+}
+
+// names returns the domains of the domain file in sorted order, so that the default
+// domain is the same on every start when Options.Domains is empty.
+func (d *domains) names() []string {
+	names := make([]string, 0, len(d.settings))
+	for name := range d.settings {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// maxTTL returns the longest rule expiration of all domains.
+func (d *domains) maxTTL() time.Duration {
+	ttl := d.fallback.ttl
+	for _, ds := range d.settings {
+		ttl = max(ttl, ds.ttl)
+	}
+	return ttl
+}
+
+// minTTL returns the shortest rule expiration of all domains, zero if no rules expire.
+func (d *domains) minTTL() time.Duration {
+	ttl := d.fallback.ttl
+	for _, ds := range d.settings {
+		if ds.ttl > 0 && (ttl <= 0 || ds.ttl < ttl) {
+			ttl = ds.ttl
+		}
+	}
+	return max(ttl, 0)
+}
+
+// check reports whether name, a rule key without its wildcard prefix,
+// is a valid host prefix under the domain. Names shorter than the minimum
+// length are checked by the callers.
+func (ds *domainSettings) check(name string) error {
+	if ds.max > 0 && len(name) > ds.max {
+		return fmt.Errorf("%w: longer than %d characters", ErrHostInvalid, ds.max)
+	}
+	if ds.charset != nil {
+		for _, label := range strings.Split(name, ".") {
+			if !ds.charset.MatchString(label) {
+				return fmt.Errorf("%w: %q has disallowed characters", ErrHostInvalid, label)
+			}
+		}
+	}
+	return nil
+}
+
+// expiration returns the lifetime of the rule r, set by the domain it was claimed under.
+func (s *server) expiration(r *rule) time.Duration {
+	return s.domains.get(r.Domain).ttl
+}
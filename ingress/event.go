@@ -0,0 +1,153 @@
+package ingress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultEventChannel = "gost:pubsub:ingress:events"
+)
+
+// Actions of rule change events.
+const (
+	EventClaim    = "claim"
+	EventRefresh  = "refresh"
+	EventRelease  = "release"
+	EventTransfer = "transfer"
+	EventJoin     = "join"
+	EventLeave    = "leave"
+	EventReap     = "reap"
+	EventExpire   = "expire"
+)
+
+// Event is published to Options.EventChannel when a rule changes.
+type Event struct {
+	// host name served by the rule, followed by its path prefix if any
+	Host string `json:"host"`
+	// rule key
+	Key string `json:"key"`
+	// the tunnel the change applies to, empty for expirations
+	Tunnel string    `json:"tunnel,omitempty"`
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"`
+}
+
+// removed reports whether the rule is gone after an event with action.
+func removed(action string) bool {
+	switch action {
+	case EventRelease, EventReap, EventExpire:
+		return true
+	default:
+		return false
+	}
+}
+
+// publish sends a rule change event for the rule r stored under key, nil if the rule
+// is gone, if events are enabled, and drops the rule from the local cache.
+func (s *server) publish(ctx context.Context, action, key string, r *rule, t tunnel) {
+	s.cache.remove(key)
+	if removed(action) {
+		s.balancer.forget(key)
+	}
+
+	if s.opts.EventChannel == "" {
+		return
+	}
+
+	ev := Event{
+		Host:   s.ruleHost(key, r),
+		Key:    key,
+		Action: action,
+		Time:   time.Now(),
+	}
+	if !t.IsZero() {
+		ev.Tunnel = t.String()
+	}
+	v, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error(fmt.Sprintf("event: %v", err))
+		return
+	}
+	if err := s.client.Publish(ctx, s.opts.EventChannel, v).Err(); err != nil {
+		slog.Error(fmt.Sprintf("event %s %s: %v", action, key, err))
+	}
+}
+
+// watchExpired publishes expire events for rules expired by Redis, driven by keyspace
+// notifications. Keyspace notifications for expired keys (notify-keyspace-events Ex)
+// are enabled on the Redis server if possible.
+func (s *server) watchExpired(ctx context.Context) {
+	s.enableExpiredNotifications(ctx)
+
+	pubsub := s.client.Subscribe(ctx, fmt.Sprintf("__keyevent@%d__:expired", s.opts.RedisDB))
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			// skip the keys the plugin keeps besides rules.
+			key, ok := s.keys.parseRule(msg.Payload)
+			if !ok {
+				continue
+			}
+			s.balancer.forget(key)
+
+			// with several replicas, only the first one publishes. The mark outlives
+			// the notification but not a rule claimed anew, which expires at the earliest
+			// after the shortest rule expiration.
+			ok, err := s.client.SetNX(ctx, s.keys.expired(key), 1, s.expiredMark()).Result()
+			if err != nil {
+				slog.Error(fmt.Sprintf("expired %s: %v", key, err))
+				continue
+			}
+			if ok {
+				slog.Debug(fmt.Sprintf("expired: %s", key))
+				s.forget(ctx, key)
+				s.publish(ctx, EventExpire, key, nil, tunnel{})
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expiredMark returns the lifetime of the marks of published expirations:
+// half of the shortest rule expiration, at most a minute.
+func (s *server) expiredMark() time.Duration {
+	d := time.Minute
+	if ttl := s.domains.minTTL(); ttl > 0 {
+		d = min(d, ttl/2)
+	}
+	return d
+}
+
+func (s *server) enableExpiredNotifications(ctx context.Context) {
+	v, err := s.client.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil || len(v) < 2 {
+		slog.Warn(fmt.Sprintf("expired events: notify-keyspace-events can not be read, make sure it includes 'Ex': %v", err))
+		return
+	}
+
+	flags, _ := v[1].(string)
+	if strings.Contains(flags, "E") && (strings.Contains(flags, "x") || strings.Contains(flags, "A")) {
+		return
+	}
+	if !strings.Contains(flags, "E") {
+		flags += "E"
+	}
+	if !strings.Contains(flags, "x") && !strings.Contains(flags, "A") {
+		flags += "x"
+	}
+	if err := s.client.ConfigSet(ctx, "notify-keyspace-events", flags).Err(); err != nil {
+		slog.Warn(fmt.Sprintf("expired events: set notify-keyspace-events to '%s' on the Redis server: %v", flags, err))
+	}
+}
@@ -0,0 +1,85 @@
+package ingress
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// hostProfile maps internationalized host names to their ASCII (punycode) form
+// the way browsers do for lookups, lowercasing them on the way.
+var hostProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.VerifyDNSLength(true),
+	idna.Transitional(false),
+)
+
+// normalizeHost returns the canonical form of the host of a rule request:
+// the port and a trailing dot are dropped, the name is lowercased and converted
+// to punycode, and its labels are validated per RFC 1123. A leading "*."
+// wildcard label is kept. Empty hosts and a bare "*" are returned as is.
+func normalizeHost(host string) (string, error) {
+	if v, _, _ := net.SplitHostPort(host); v != "" {
+		host = v
+	}
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || host == "*" {
+		return host, nil
+	}
+
+	name, wildcard := strings.CutPrefix(host, "*.")
+	name, err := hostProfile.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrHostInvalid, err)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if err := checkLabel(label); err != nil {
+			return "", err
+		}
+	}
+
+	if wildcard {
+		name = "*." + name
+	}
+	return name, nil
+}
+
+// checkLabel reports whether label is a valid RFC 1123 host name label:
+// 1 to 63 letters, digits and hyphens, not starting or ending with a hyphen.
+func checkLabel(label string) error {
+	if label == "" || len(label) > 63 {
+		return fmt.Errorf("%w: label %q must be 1 to 63 characters", ErrHostInvalid, label)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("%w: label %q starts or ends with a hyphen", ErrHostInvalid, label)
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-') {
+			return fmt.Errorf("%w: label %q has invalid characters", ErrHostInvalid, label)
+		}
+	}
+	return nil
+}
+
+// normalizeDomains returns the canonical forms of domains, skipping empty ones.
+func normalizeDomains(domains []string) ([]string, error) {
+	var names []string
+	for _, d := range domains {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		}
+		name, err := normalizeHost(d)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d, err)
+		}
+		if strings.HasPrefix(name, "*") {
+			return nil, fmt.Errorf("%s: %w", d, ErrHostInvalid)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
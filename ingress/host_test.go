@@ -0,0 +1,74 @@
+package ingress
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		want    string
+		invalid bool
+	}{
+		{"", "", false},
+		{"*", "*", false},
+		{"foo.gost.run", "foo.gost.run", false},
+		{"Foo.GOST.run", "foo.gost.run", false},
+		{"foo.gost.run.", "foo.gost.run", false},
+		{"foo.gost.run:8080", "foo.gost.run", false},
+		{"*.Example.com", "*.example.com", false},
+		{"bücher.example", "xn--bcher-kva.example", false},
+		{"*.bücher.example", "*.xn--bcher-kva.example", false},
+		{"foo..gost.run", "", true},
+		{"-foo.gost.run", "", true},
+		{"foo-.gost.run", "", true},
+		{"foo_bar.gost.run", "", true},
+		{"foo.*.gost.run", "", true},
+		{strings.Repeat("a", 64) + ".gost.run", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeHost(tt.host)
+		if tt.invalid {
+			if !errors.Is(err, ErrHostInvalid) {
+				t.Errorf("normalizeHost(%q) = %q, %v, want ErrHostInvalid", tt.host, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeHost(%q) = %q, %v, want %q", tt.host, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckLabel(t *testing.T) {
+	tests := []struct {
+		label string
+		valid bool
+	}{
+		{"a", true},
+		{"foo", true},
+		{"foo-bar", true},
+		{"f00", true},
+		{"xn--bcher-kva", true},
+		{strings.Repeat("a", 63), true},
+		{"", false},
+		{strings.Repeat("a", 64), false},
+		{"-foo", false},
+		{"foo-", false},
+		{"Foo", false},
+		{"foo_bar", false},
+		{"foo.bar", false},
+		{"*", false},
+	}
+	for _, tt := range tests {
+		err := checkLabel(tt.label)
+		if tt.valid && err != nil {
+			t.Errorf("checkLabel(%q) = %v, want nil", tt.label, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrHostInvalid) {
+			t.Errorf("checkLabel(%q) = %v, want ErrHostInvalid", tt.label, err)
+		}
+	}
+}
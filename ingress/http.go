@@ -0,0 +1,125 @@
+package ingress
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ginuerzh/gost-plugins/internal/util"
+	ingress_proto "github.com/go-gost/plugin/ingress/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type httpSetRuleRequest struct {
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	Endpoint string `json:"endpoint"`
+	Service  string `json:"service"`
+}
+
+type httpSetRuleReply struct {
+	Ok bool `json:"ok"`
+	// the allocated host of requests with an empty or wildcard host
+	Host  string `json:"host,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type httpGetRuleReply struct {
+	Endpoint string `json:"endpoint"`
+}
+
+// httpServer serves the ingress plugin over the HTTP transport of GOST:
+//
+//	GET  /?host=<host>&path=<path>                          look up the endpoint of a host and request path
+//	POST / {"host":"<host>","path":"<path>","endpoint":"<tunnel-id>"}  set a rule
+//
+// Paths select path rules by longest prefix, see routeCandidates. The host
+// may also carry the path, e.g. "foo.gost.run/api".
+type httpServer struct {
+	srv *server
+}
+
+func listenAndServeHTTP(addr string, srv *server) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("http server listening on %v", ln.Addr()))
+
+	s := &httpServer{srv: srv}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /", s.getRule)
+	mux.HandleFunc("POST /", s.setRule)
+
+	return (&http.Server{Handler: mux}).Serve(ln)
+}
+
+func (s *httpServer) getRule(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	reply, err := s.srv.GetRule(r.Context(), &ingress_proto.GetRuleRequest{
+		Host: joinPath(q.Get("host"), q.Get("path")),
+	})
+	if err != nil {
+		util.WriteJSON(w, httpStatus(err), httpGetRuleReply{})
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, httpGetRuleReply{Endpoint: reply.Endpoint})
+}
+
+func (s *httpServer) setRule(w http.ResponseWriter, r *http.Request) {
+	var req httpSetRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.WriteJSON(w, http.StatusBadRequest, httpSetRuleReply{Error: err.Error()})
+		return
+	}
+
+	reply, host, err := s.srv.setRule(r.Context(), &ingress_proto.SetRuleRequest{
+		Host:     joinPath(req.Host, req.Path),
+		Endpoint: req.Endpoint,
+		Service:  req.Service,
+	})
+	if err != nil {
+		util.WriteJSON(w, httpStatus(err), httpSetRuleReply{Error: status.Convert(err).Message()})
+		return
+	}
+
+	util.WriteJSON(w, http.StatusOK, httpSetRuleReply{Ok: reply.Ok, Host: host})
+}
+
+// joinPath appends the request path p to host, unless host carries a path itself.
+func joinPath(host, p string) string {
+	if p == "" || strings.Contains(host, "/") {
+		return host
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return host + p
+}
+
+// httpStatus maps the gRPC status of err to an HTTP status code.
+func httpStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -24,14 +26,77 @@ type Options struct {
 	RedisUsername   string
 	RedisPassword   string
 	RedisExpiration time.Duration
-	Domains         []string
-	MinDomain       int
+	// Domains are the managed domains, the first one is the default domain.
+	Domains   []string
+	MinDomain int
+	// DomainFile is the JSON file of per-domain settings, see domainConfig.
+	// Its domains are served in addition to Domains.
+	DomainFile string
+	// Namespace prefixes the Redis keys of the plugin, see keyspace.
+	// Empty keeps the unprefixed layout of older versions.
+	Namespace string
+	// IdleTimeout frees rules whose owner has not refreshed them for this long,
+	// zero disables the reaper and rules live until RedisExpiration.
+	IdleTimeout time.Duration
+	// ReapInterval is how often the reaper looks for idle rules.
+	ReapInterval time.Duration
+	// PolicyFile is the JSON file of reserved and denied host names, see policyConfig.
+	PolicyFile string
+	// PolicyReload is how often the policy file is checked for changes, zero disables reloading.
+	PolicyReload time.Duration
+	// VerifyDomains requires custom domains, hosts outside of Domains,
+	// to pass a DNS TXT or HTTP challenge before their rules are activated.
+	VerifyDomains bool
+	// ChallengeExpiration is the lifetime of a pending challenge token, 24h by default.
+	ChallengeExpiration time.Duration
+	// Resolver looks up challenge TXT records, net.DefaultResolver if nil.
+	Resolver Resolver
+	// HTTPClient fetches HTTP challenges, if nil a client with a 10s timeout that
+	// only connects to public addresses. Redirects are never followed.
+	HTTPClient *http.Client
+	// Quota is the maximum number of rules a tunnel may own, zero for no limit.
+	Quota int
+	// QuotaPublic and QuotaPrivate override Quota for public and private tunnels.
+	QuotaPublic  int
+	QuotaPrivate int
+	// Balance is the default strategy to select one of the tunnels serving a host:
+	// BalanceRoundRobin (default), BalanceRandom or BalanceHash.
+	Balance string
+	// AllocMode selects how names are generated for rules without a host: AllocSlug (default) or AllocWord.
+	AllocMode string
+	// AllocLength is the length of generated slugs, 8 by default.
+	AllocLength int
+	// AllocAlphabet is the set of characters of generated slugs, lowercase letters and digits by default.
+	// Only lowercase letters, digits and '-' are valid.
+	AllocAlphabet string
+	// EventChannel is the Redis pub/sub channel of rule change events, empty to disable them.
+	EventChannel string
+	// EventExpired publishes events for rules expired by Redis using keyspace notifications.
+	EventExpired bool
+	// CacheSize is the maximum number of rules cached for GetRule, zero disables the cache.
+	// Cached rules are dropped on change events from EventChannel.
+	CacheSize int
+	// CacheTTL and CacheNegativeTTL bound how long found and missing rules are cached.
+	CacheTTL         time.Duration
+	CacheNegativeTTL time.Duration
+	// HTTPAddr is the listen address of the HTTP transport of the plugin, empty to disable it.
+	// Unlike gRPC lookups, HTTP lookups carry the request path for path rules.
+	HTTPAddr string
+	// AdminAddr is the listen address of the admin HTTP API, empty to disable it.
+	AdminAddr string
+	// AdminToken authorizes forced rule operations on the admin API.
+	AdminToken string
 }
 
 type server struct {
 	client *redis.Client
 	ingress_proto.UnimplementedIngressServer
-	opts *Options
+	policy   *policyLoader
+	domains  *domains
+	balancer balancer
+	cache    *ruleCache
+	keys     keyspace
+	opts     *Options
 }
 
 // ListenAndServe starts the ingress gRPC server on addr using the given Redis-backed options.
@@ -40,6 +105,40 @@ func ListenAndServe(addr string, opts *Options) error {
 		opts = &Options{}
 	}
 
+	if !validStrategy(opts.Balance) {
+		return fmt.Errorf("%w: %s", ErrInvalidStrategy, opts.Balance)
+	}
+	if opts.AllocAlphabet != "" {
+		if err := checkAlphabet(opts.AllocAlphabet); err != nil {
+			return err
+		}
+	}
+
+	var policy *policyLoader
+	if opts.PolicyFile != "" {
+		var err error
+		if policy, err = newPolicyLoader(opts.PolicyFile); err != nil {
+			return fmt.Errorf("policy: %w", err)
+		}
+	}
+
+	domains, err := newDomains(opts)
+	if err != nil {
+		return fmt.Errorf("domains: %w", err)
+	}
+	names, err := normalizeDomains(opts.Domains)
+	if err != nil {
+		return fmt.Errorf("domains: %w", err)
+	}
+	for _, name := range domains.names() {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	o := *opts
+	o.Domains = names
+	opts = &o
+
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
@@ -54,80 +153,363 @@ func ListenAndServe(addr string, opts *Options) error {
 			Username: opts.RedisUsername,
 			Password: opts.RedisPassword,
 		}),
-		opts: opts,
+		policy:  policy,
+		domains: domains,
+		cache:   newRuleCache(opts.CacheSize, opts.CacheTTL, opts.CacheNegativeTTL),
+		keys:    keyspace{namespace: opts.Namespace},
+		opts:    opts,
 	}
 	defer srv.client.Close()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if opts.IdleTimeout > 0 {
+		go srv.runReaper(ctx)
+	}
+	if opts.EventExpired {
+		go srv.watchExpired(ctx)
+	}
+	if opts.EventChannel != "" {
+		go srv.watchEvents(ctx)
+	}
+	if policy != nil && opts.PolicyReload > 0 {
+		go policy.run(ctx, opts.PolicyReload)
+	}
+
+	if opts.HTTPAddr != "" {
+		go func() {
+			if err := listenAndServeHTTP(opts.HTTPAddr, srv); err != nil {
+				slog.Error(fmt.Sprintf("http: %v", err))
+			}
+		}()
+	}
+	if opts.AdminAddr != "" {
+		go func() {
+			if err := listenAndServeAdmin(opts.AdminAddr, srv); err != nil {
+				slog.Error(fmt.Sprintf("admin: %v", err))
+			}
+		}()
+	}
+
 	ingress_proto.RegisterIngressServer(s, srv)
 	return s.Serve(ln)
 }
 
 func (s *server) SetRule(ctx context.Context, in *ingress_proto.SetRuleRequest) (*ingress_proto.SetRuleReply, error) {
+	reply, host, err := s.setRule(ctx, in)
+	if err == nil && host != "" {
+		setAllocHeader(ctx, host)
+	}
+	return reply, err
+}
+
+// setRule claims the rule of the request, or allocates one for an empty or bare
+// wildcard host. It returns the allocated host, empty if none was allocated.
+func (s *server) setRule(ctx context.Context, in *ingress_proto.SetRuleRequest) (*ingress_proto.SetRuleReply, string, error) {
 	reply := &ingress_proto.SetRuleReply{}
 
 	tid := parseTunnelID(in.Endpoint)
-	if in.Host == "" || tid.IsZero() {
-		return nil, status.Error(codes.InvalidArgument, "invalid args")
+	if tid.IsZero() {
+		return nil, "", status.Error(codes.InvalidArgument, "invalid args")
 	}
 
-	host := in.Host
-	if v, _, _ := net.SplitHostPort(in.Host); v != "" {
-		host = v
+	host, prefix := splitPath(in.Host)
+	host, err := normalizeHost(host)
+	if err != nil {
+		return nil, "", status.Error(codes.InvalidArgument, err.Error())
 	}
-	if len(host) < s.opts.MinDomain {
-		return reply, nil
+	if pathDepth(prefix) > maxPathDepth {
+		return nil, "", status.Error(codes.InvalidArgument, fmt.Sprintf("path deeper than %d segments", maxPathDepth))
 	}
 
-	ok, err := s.client.SetNX(ctx, host, tid.String(), s.opts.RedisExpiration).Result()
-	if err != nil {
-		slog.Error(err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-	if ok {
-		slog.Debug(fmt.Sprintf("set: %s -> %s -> %s", in.Host, host, tid.String()))
-		reply.Ok = true
-	} else {
-		if v, err := s.client.Get(ctx, host).Result(); err != nil {
-			slog.Error(fmt.Sprintf("get: %v", err))
-		} else if v == in.Endpoint {
-			reply.Ok = true
+	key, domain := s.splitDomain(host)
+	// an empty or bare wildcard host asks for a generated name.
+	if key == "" || key == "*" {
+		if prefix != "" {
+			return nil, "", status.Error(codes.InvalidArgument, "path rules require a host")
 		}
+		return s.allocRule(ctx, in, tid, domain)
 	}
-	return reply, nil
+
+	base, wildcard := strings.CutPrefix(key, "*.")
+	if base == "" || strings.Contains(base, "*") {
+		return nil, "", status.Error(codes.InvalidArgument, "invalid host")
+	}
+	// a wildcard outside of the managed domains must not cover a whole TLD.
+	if wildcard && domain == "" && !strings.Contains(base, ".") {
+		return nil, "", status.Error(codes.InvalidArgument, "invalid host")
+	}
+	ds := s.domains.get(domain)
+	if len(base) < ds.min {
+		return reply, "", nil
+	}
+	if err := ds.check(base); err != nil {
+		return nil, "", status.Error(codes.InvalidArgument, fmt.Sprintf("%s: %v", key, err))
+	}
+
+	t := newTunnel(tid)
+	if in.Service != "" {
+		t.Metadata = map[string]string{"service": in.Service}
+	}
+	if t.Private && !ds.private {
+		return nil, "", status.Error(codes.PermissionDenied, fmt.Sprintf("%s: %v", key, ErrPrivateDenied))
+	}
+	if err := s.policy.get().check(key, t); err != nil {
+		slog.Warn(fmt.Sprintf("set: %s -> %s: %v", in.Host, t, err))
+		return nil, "", status.Error(codes.PermissionDenied, fmt.Sprintf("%s: %v", key, err))
+	}
+
+	r := newRule(t)
+	r.Domain = domain
+	r.Custom = domain == ""
+	if s.opts.VerifyDomains && customDomain(host, key) {
+		if err := s.verify(ctx, key, r); err != nil {
+			slog.Warn(fmt.Sprintf("set: %s -> %s: %v", in.Host, t, err))
+			return nil, "", ruleStatus(key, err)
+		}
+	}
+	rk := s.domainKey(key+prefix, domain)
+	if rk != key+prefix {
+		if err := s.checkLegacyRule(ctx, key+prefix, t); err != nil {
+			slog.Warn(fmt.Sprintf("set: %s -> %s: %v", in.Host, t, err))
+			return nil, "", ruleStatus(rk, err)
+		}
+	}
+	if err := s.claim(ctx, rk, r); err != nil {
+		slog.Warn(fmt.Sprintf("set: %s -> %s: %v", in.Host, t, err))
+		return nil, "", ruleStatus(rk, err)
+	}
+	slog.Debug(fmt.Sprintf("set: %s -> %s -> %s", in.Host, rk, t))
+
+	reply.Ok = true
+	return reply, "", nil
+}
+
+func (s *server) allocRule(ctx context.Context, in *ingress_proto.SetRuleRequest, tid relay.TunnelID, domain string) (*ingress_proto.SetRuleReply, string, error) {
+	if domain == "" {
+		domain = s.defaultDomain()
+	}
+
+	t := newTunnel(tid)
+	if in.Service != "" {
+		t.Metadata = map[string]string{"service": in.Service}
+	}
+	if t.Private && !s.domains.get(domain).private {
+		return nil, "", status.Error(codes.PermissionDenied, fmt.Sprintf("%s: %v", domain, ErrPrivateDenied))
+	}
+
+	r := newRule(t)
+	r.Domain = domain
+	host, err := s.allocate(ctx, domain, r)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("set: %s -> %s: %v", in.Host, t, err))
+		return nil, "", ruleStatus(in.Host, err)
+	}
+	return &ingress_proto.SetRuleReply{Ok: true}, host, nil
 }
 
 func (s *server) GetRule(ctx context.Context, in *ingress_proto.GetRuleRequest) (*ingress_proto.GetRuleReply, error) {
-	host := in.Host
-	if v, _, _ := net.SplitHostPort(in.Host); v != "" {
-		host = v
+	host, prefix := splitPath(in.Host)
+	host, err := normalizeHost(host)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	reply := &ingress_proto.GetRuleReply{}
 
-	key := host
-	for _, domain := range s.opts.Domains {
-		if strings.HasSuffix(host, domain) {
-			if n := strings.IndexByte(host, '.'); n > 0 {
-				key = host[:n]
-			}
+	key, domain := s.splitDomain(host)
+	if len(key) >= s.domains.get(domain).min {
+		verify := s.opts.VerifyDomains && customDomain(host, key)
+		names := routeCandidates(key, prefix)
+		keys := make([]string, 0, 2*len(names))
+		for _, name := range names {
+			keys = append(keys, s.domainKey(name, domain))
 		}
-	}
-	if len(key) >= s.opts.MinDomain {
-		var err error
-		reply.Endpoint, err = s.client.Get(ctx, key).Result()
+		if keys[0] != names[0] {
+			// rules of older versions keyed without the domain.
+			keys = append(keys, names...)
+		}
+		rules, err := s.lookupRules(ctx, keys)
 		if err != nil {
-			if err == redis.Nil {
-				return reply, nil
-			}
 			slog.Error(fmt.Sprintf("get: %v", err))
 			return nil, status.Error(codes.Internal, err.Error())
 		}
+		for i, r := range rules {
+			if r == nil || r.Tunnel.IsZero() {
+				continue
+			}
+			// the same name claimed under the default domain or as a custom host.
+			if !s.servesDomain(r, domain) {
+				continue
+			}
+			if verify && !r.Verified {
+				continue
+			}
+			strategy := r.Strategy
+			if strategy == "" {
+				strategy = s.opts.Balance
+			}
+			t, ok := s.balancer.pick(ctx, keys[i], strategy, r.live(s.expiration(r)))
+			if !ok {
+				continue
+			}
+			key = keys[i]
+			reply.Endpoint = t.String()
+			break
+		}
 	}
 
 	slog.Debug(fmt.Sprintf("ingress: %s -> %s -> %s", in.Host, key, reply.Endpoint))
 	return reply, nil
 }
 
+// lookupRules returns the rules stored under keys, nil for missing rules.
+// Rules are served from the cache if possible.
+func (s *server) lookupRules(ctx context.Context, keys []string) ([]*rule, error) {
+	rules := make([]*rule, len(keys))
+
+	var missing []string
+	for i, key := range keys {
+		r, ok := s.cache.get(key)
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		rules[i] = r
+	}
+	s.cache.record(rules, len(missing) > 0)
+	if len(missing) == 0 {
+		return rules, nil
+	}
+
+	vs, err := s.client.MGet(ctx, s.keys.rules(missing)...).Result()
+	if err != nil {
+		return nil, err
+	}
+	fetched := make(map[string]*rule, len(missing))
+	for i, v := range vs {
+		var r *rule
+		if sv, _ := v.(string); sv != "" {
+			if r, err = decodeRule(sv); err != nil {
+				slog.Error(fmt.Sprintf("get %s: %v", missing[i], err))
+				continue
+			}
+		}
+		fetched[missing[i]] = r
+		s.cache.set(missing[i], r)
+	}
+	for i, key := range keys {
+		if r, ok := fetched[key]; ok {
+			rules[i] = r
+		}
+	}
+
+	return rules, nil
+}
+
+// ruleKey returns the rule key of host and the domain it is under, see splitDomain
+// and domainKey: "api.team1.gost.run" becomes "api.team1" under the default domain
+// gost.run and "api.team1.tmp.gost.run" is kept whole under the domain tmp.gost.run.
+func (s *server) ruleKey(host string) (key, domain string) {
+	key, domain = s.splitDomain(host)
+	return s.domainKey(key, domain), domain
+}
+
+// defaultDomain returns the first of Options.Domains, empty if there is none.
+func (s *server) defaultDomain() string {
+	if len(s.opts.Domains) == 0 {
+		return ""
+	}
+	return s.opts.Domains[0]
+}
+
+// splitDomain splits host into its name relative to the longest of Options.Domains it
+// is under and that domain. A bare prefix, a single label such as "foo" or "*.foo", is
+// under the default domain. The domain is empty and the name is host itself if host is
+// not under any of them.
+func (s *server) splitDomain(host string) (key, domain string) {
+	for _, d := range s.opts.Domains {
+		if d != "" && len(d) > len(domain) && strings.HasSuffix(host, "."+d) {
+			domain = d
+		}
+	}
+	if domain == "" {
+		name := strings.TrimPrefix(host, "*.")
+		if name != "" && name != "*" && !strings.Contains(name, ".") && s.defaultDomain() != "" {
+			return host, s.defaultDomain()
+		}
+		return host, ""
+	}
+	return host[:len(host)-len(domain)-1], domain
+}
+
+// domainKey returns the rule key of the name key, possibly followed by a path prefix,
+// under domain. Names under the default domain and custom hosts are keyed as is, like
+// older versions did for all domains. Names under the other domains are keyed by their
+// full host name, so that the same name has independent owners under each domain.
+func (s *server) domainKey(key, domain string) string {
+	if domain == "" || domain == s.defaultDomain() {
+		return key
+	}
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		return key[:i] + "." + domain + key[i:]
+	}
+	return key + "." + domain
+}
+
+// ruleHost returns the host name served by the rule r under key, followed by its path
+// prefix if any. Names under the default domain are keyed relative to it. Without the
+// rule, a name of several labels outside of the domains is taken for a custom host.
+func (s *server) ruleHost(key string, r *rule) string {
+	d := s.defaultDomain()
+	if d == "" || r != nil && r.Custom {
+		return key
+	}
+	name, p := key, ""
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		name, p = key[:i], key[i:]
+	}
+	for _, domain := range s.opts.Domains {
+		if strings.HasSuffix(name, "."+domain) {
+			return key
+		}
+	}
+	if r == nil && strings.Contains(strings.TrimPrefix(name, "*."), ".") {
+		return key
+	}
+	return name + "." + d + p
+}
+
+// servesDomain reports whether the rule r may serve hosts under domain, empty for custom
+// hosts. Rules of older versions do not record their domain and, keyed by the name
+// relative to any domain, serve it under all of them.
+func (s *server) servesDomain(r *rule, domain string) bool {
+	if r.Custom {
+		return domain == ""
+	}
+	if r.Domain == "" {
+		return true
+	}
+	return r.Domain == domain
+}
+
+// ruleCandidates returns the rule keys that may serve key, most specific first:
+// the exact key followed by the wildcard keys of each of its parent suffixes,
+// e.g. "a.b.c" -> ["a.b.c", "*.b.c", "*.c"].
+func ruleCandidates(key string) []string {
+	keys := []string{key}
+	for s := key; ; {
+		n := strings.IndexByte(s, '.')
+		if n < 0 || n == len(s)-1 {
+			break
+		}
+		s = s[n+1:]
+		keys = append(keys, "*."+s)
+	}
+	return keys
+}
+
 func parseTunnelID(s string) (tid relay.TunnelID) {
 	if s == "" {
 		return
@@ -0,0 +1,145 @@
+package ingress
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRuleCandidates(t *testing.T) {
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{"foo", []string{"foo"}},
+		{"foo.gost", []string{"foo.gost", "*.gost"}},
+		{"a.b.c", []string{"a.b.c", "*.b.c", "*.c"}},
+		{"api.foo.example.com", []string{"api.foo.example.com", "*.foo.example.com", "*.example.com", "*.com"}},
+		{"xn--80ak6aa92e.com", []string{"xn--80ak6aa92e.com", "*.com"}},
+	}
+	for _, tt := range tests {
+		if got := ruleCandidates(tt.key); !slices.Equal(got, tt.want) {
+			t.Errorf("ruleCandidates(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestRuleKey(t *testing.T) {
+	s := &server{opts: &Options{Domains: []string{"gost.run", "tmp.gost.run"}}}
+
+	tests := []struct {
+		host, key, domain string
+	}{
+		{"foo.gost.run", "foo", "gost.run"},
+		{"api.team1.gost.run", "api.team1", "gost.run"},
+		{"*.team1.gost.run", "*.team1", "gost.run"},
+		{"foo", "foo", "gost.run"},
+		{"*.foo", "*.foo", "gost.run"},
+		{"foo.tmp.gost.run", "foo.tmp.gost.run", "tmp.gost.run"},
+		{"*.foo.tmp.gost.run", "*.foo.tmp.gost.run", "tmp.gost.run"},
+		{"foo.example.com", "foo.example.com", ""},
+	}
+	for _, tt := range tests {
+		key, domain := s.ruleKey(tt.host)
+		if key != tt.key || domain != tt.domain {
+			t.Errorf("ruleKey(%q) = %q, %q, want %q, %q", tt.host, key, domain, tt.key, tt.domain)
+		}
+	}
+
+	if got := s.domainKey("foo/api", "tmp.gost.run"); got != "foo.tmp.gost.run/api" {
+		t.Errorf("domainKey(%q) = %q, want %q", "foo/api", got, "foo.tmp.gost.run/api")
+	}
+}
+
+func TestServesDomain(t *testing.T) {
+	s := &server{opts: &Options{Domains: []string{"gost.run", "tmp.gost.run"}}}
+
+	tests := []struct {
+		r      rule
+		domain string
+		want   bool
+	}{
+		{rule{Domain: "gost.run"}, "gost.run", true},
+		{rule{Domain: "gost.run"}, "tmp.gost.run", false},
+		{rule{Domain: "gost.run"}, "", false},
+		{rule{Domain: "tmp.gost.run"}, "tmp.gost.run", true},
+		{rule{Custom: true}, "", true},
+		{rule{Custom: true}, "gost.run", false},
+		// rules of older versions
+		{rule{}, "gost.run", true},
+		{rule{}, "tmp.gost.run", true},
+		{rule{}, "", true},
+	}
+	for _, tt := range tests {
+		if got := s.servesDomain(&tt.r, tt.domain); got != tt.want {
+			t.Errorf("servesDomain(%+v, %q) = %v, want %v", tt.r, tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestDomainNames(t *testing.T) {
+	d := &domains{settings: map[string]*domainSettings{}}
+	for _, name := range []string{"e.run", "b.run", "d.run", "a.run", "c.run"} {
+		d.settings[name] = &domainSettings{}
+	}
+	want := []string{"a.run", "b.run", "c.run", "d.run", "e.run"}
+	for i := 0; i < 10; i++ {
+		if got := d.names(); !slices.Equal(got, want) {
+			t.Fatalf("names() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestRuleHost(t *testing.T) {
+	s := &server{opts: &Options{Domains: []string{"gost.run", "tmp.gost.run"}}}
+
+	tests := []struct {
+		key  string
+		r    *rule
+		want string
+	}{
+		{"foo", &rule{Domain: "gost.run"}, "foo.gost.run"},
+		{"foo/api", &rule{Domain: "gost.run"}, "foo.gost.run/api"},
+		{"api.team1", &rule{Domain: "gost.run"}, "api.team1.gost.run"},
+		{"*.team1", &rule{}, "*.team1.gost.run"},
+		{"foo.tmp.gost.run/api", &rule{Domain: "tmp.gost.run"}, "foo.tmp.gost.run/api"},
+		{"api.example.com", &rule{Custom: true}, "api.example.com"},
+		// expired rules
+		{"foo", nil, "foo.gost.run"},
+		{"*.foo", nil, "*.foo.gost.run"},
+		{"foo.tmp.gost.run", nil, "foo.tmp.gost.run"},
+		{"api.example.com/v1", nil, "api.example.com/v1"},
+	}
+	for _, tt := range tests {
+		if got := s.ruleHost(tt.key, tt.r); got != tt.want {
+			t.Errorf("ruleHost(%q, %+v) = %q, want %q", tt.key, tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		namespace, rk string
+		key           string
+		ok            bool
+	}{
+		{"", "foo", "foo", true},
+		{"", "*.foo.example.com", "*.foo.example.com", true},
+		{"", "foo/api/v1", "foo/api/v1", true},
+		{"", "gost:ingress:seen", "", false},
+		{"", "gost:sd:services", "", false},
+		{"", "session:1234", "", false},
+		{"", "Foo", "", false},
+		{"", "foo/api/", "", false},
+		{"", "foo//api", "", false},
+		{"", "-foo", "", false},
+		{"", "", "", false},
+		{"n", "n:rule:foo", "foo", true},
+		{"n", "n:seen", "", false},
+	}
+	for _, tt := range tests {
+		key, ok := keyspace{namespace: tt.namespace}.parseRule(tt.rk)
+		if ok != tt.ok || ok && key != tt.key {
+			t.Errorf("parseRule(%q) in %q = %q, %v, want %q, %v", tt.rk, tt.namespace, key, ok, tt.key, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package ingress
+
+import (
+	"strings"
+)
+
+const (
+	// root of the internal keys when no namespace is configured
+	legacyKeyRoot = "gost:ingress"
+)
+
+// keyspace maps rule keys and the plugin's internal records to Redis keys.
+//
+// Without a namespace the layout of older versions is kept: rules are stored
+// under their bare rule key and internal records under "gost:ingress:".
+// With namespace N, rules are stored under "N:rule:<key>" and internal records under "N:".
+type keyspace struct {
+	namespace string
+}
+
+func (ks keyspace) root() string {
+	if ks.namespace == "" {
+		return legacyKeyRoot
+	}
+	return ks.namespace
+}
+
+// rule returns the Redis key of the rule key.
+func (ks keyspace) rule(key string) string {
+	if ks.namespace == "" {
+		return key
+	}
+	return ks.namespace + ":rule:" + key
+}
+
+func (ks keyspace) rules(keys []string) []string {
+	rks := make([]string, len(keys))
+	for i, key := range keys {
+		rks[i] = ks.rule(key)
+	}
+	return rks
+}
+
+// parseRule returns the rule key stored under the Redis key rk,
+// ok is false if rk does not hold a rule. Without a namespace rules share the
+// keyspace with other data, so only keys of the form of a rule key are taken.
+func (ks keyspace) parseRule(rk string) (key string, ok bool) {
+	if ks.namespace == "" {
+		return rk, !strings.HasPrefix(rk, "gost:") && validRuleKey(rk)
+	}
+	return strings.CutPrefix(rk, ks.namespace+":rule:")
+}
+
+// validRuleKey reports whether key has the form of a rule key: a host name of
+// RFC 1123 labels with an optional leading "*." and an optional clean path prefix.
+func validRuleKey(key string) bool {
+	host, p, ok := strings.Cut(key, "/")
+	if ok && cleanPath(p) != "/"+p {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimPrefix(host, "*."), ".") {
+		if checkLabel(label) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// seen is the sorted set of rule keys scored by the unix time they were last claimed or refreshed.
+func (ks keyspace) seen() string {
+	return ks.root() + ":seen"
+}
+
+// tunnel is the set of rule keys served by the tunnel t.
+func (ks keyspace) tunnel(t tunnel) string {
+	return ks.root() + ":tunnel:" + t.ID
+}
+
+// challenge holds the pending challenge token of the tunnel t for the custom domain key.
+func (ks keyspace) challenge(key string, t tunnel) string {
+	return ks.root() + ":challenge:" + key + ":" + t.ID
+}
+
+// expired marks an expiration already published by one of the ingress replicas.
+func (ks keyspace) expired(key string) string {
+	return ks.root() + ":expired:" + key
+}
@@ -0,0 +1,139 @@
+package ingress
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ginuerzh/gost-plugins/internal/util"
+	"github.com/go-redis/redis/v8"
+)
+
+// RuleInfo describes a rule in admin listings.
+type RuleInfo struct {
+	// rule key
+	Host string `json:"host"`
+	// domain the rule was claimed under, empty for custom hosts and rules of older versions
+	Domain   string       `json:"domain,omitempty"`
+	Tunnel   string       `json:"tunnel"`
+	Members  []MemberInfo `json:"members,omitempty"`
+	Strategy string       `json:"strategy,omitempty"`
+	Verified bool         `json:"verified,omitempty"`
+	Created  time.Time    `json:"created,omitzero"`
+	// remaining time to live in seconds, -1 if the rule does not expire
+	TTL int64 `json:"ttl"`
+}
+
+// MemberInfo describes a member tunnel of a rule in admin listings.
+type MemberInfo struct {
+	Tunnel string    `json:"tunnel"`
+	Weight int       `json:"weight"`
+	Renew  time.Time `json:"renew"`
+}
+
+func newRuleInfo(key string, r *rule, ttl time.Duration) RuleInfo {
+	info := RuleInfo{
+		Host:     key,
+		Domain:   r.Domain,
+		Tunnel:   r.Tunnel.String(),
+		Strategy: r.Strategy,
+		Verified: r.Verified,
+		TTL:      -1,
+	}
+	if r.Created > 0 {
+		info.Created = time.Unix(r.Created, 0)
+	}
+	if ttl >= 0 {
+		info.TTL = int64(ttl.Seconds())
+	}
+	for i := range r.Members {
+		m := &r.Members[i]
+		info.Members = append(info.Members, MemberInfo{
+			Tunnel: m.Tunnel.String(),
+			Weight: m.weight(),
+			Renew:  time.Unix(m.Renew, 0),
+		})
+	}
+	return info
+}
+
+// listRules returns a page of rules whose keys start with prefix, starting at cursor.
+// The returned cursor is zero when the listing is complete.
+func (s *server) listRules(ctx context.Context, cursor uint64, count int64, prefix string) ([]RuleInfo, uint64, error) {
+	match := s.keys.rule(util.EscapeGlob(prefix)) + "*"
+	rks, next, err := s.client.Scan(ctx, cursor, match, count).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var keys []string
+	for _, rk := range rks {
+		if key, ok := s.keys.parseRule(rk); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	rules, err := s.ruleInfos(ctx, keys)
+	return rules, next, err
+}
+
+// listTunnelRules returns a page of the rules served by the tunnel t whose keys start with prefix.
+// The cursor is an offset into the sorted keys, the returned cursor is zero when the listing is complete.
+func (s *server) listTunnelRules(ctx context.Context, t tunnel, cursor uint64, count int64, prefix string) ([]RuleInfo, uint64, error) {
+	keys, err := s.tunnelRules(ctx, t)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys = slices.DeleteFunc(keys, func(key string) bool { return !strings.HasPrefix(key, prefix) })
+	slices.Sort(keys)
+
+	if cursor >= uint64(len(keys)) {
+		return nil, 0, nil
+	}
+	keys = keys[cursor:]
+	var next uint64
+	if int64(len(keys)) > count {
+		keys = keys[:count]
+		next = cursor + uint64(count)
+	}
+
+	rules, err := s.ruleInfos(ctx, keys)
+	return rules, next, err
+}
+
+// ruleInfos reads the rules stored under keys along with their TTL.
+// Keys that do not hold a rule are skipped.
+func (s *server) ruleInfos(ctx context.Context, keys []string) ([]RuleInfo, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	gets := make([]*redis.StringCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			gets[i] = pipe.Get(ctx, s.keys.rule(key))
+			ttls[i] = pipe.TTL(ctx, s.keys.rule(key))
+		}
+		return nil
+	})
+	// missing keys and keys of other types fail individually.
+	if err != nil && err != redis.Nil && !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		return nil, err
+	}
+
+	var rules []RuleInfo
+	for i, key := range keys {
+		v, err := gets[i].Result()
+		if err != nil {
+			continue
+		}
+		r, err := decodeRule(v)
+		if err != nil || r.Tunnel.IsZero() {
+			continue
+		}
+		rules = append(rules, newRuleInfo(key, r, ttls[i].Val()))
+	}
+	return rules, nil
+}
@@ -0,0 +1,52 @@
+package ingress
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ginuerzh/gost-plugins/internal/util"
+	"github.com/go-redis/redis/v8"
+)
+
+// Migrate moves the rules and internal records stored in the unprefixed layout
+// of older versions into Options.Namespace. With dryRun set, the keys to move
+// are only logged. Keys already present in the namespace are left untouched.
+func Migrate(ctx context.Context, opts *Options, dryRun bool) error {
+	if opts == nil || opts.Namespace == "" {
+		return errors.New("migrate: namespace is required")
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     opts.RedisAddr,
+		DB:       opts.RedisDB,
+		Username: opts.RedisUsername,
+		Password: opts.RedisPassword,
+	})
+	defer client.Close()
+
+	ks := keyspace{namespace: opts.Namespace}
+	return util.MigrateKeys(ctx, client, opts.Namespace, legacyKeyRoot, func(ctx context.Context, key string) (string, error) {
+		ok, err := migratableRule(ctx, client, key)
+		if err != nil || !ok {
+			return "", err
+		}
+		return ks.rule(key), nil
+	}, dryRun)
+}
+
+// migratableRule reports whether the unprefixed key holds an ingress rule.
+func migratableRule(ctx context.Context, client *redis.Client, key string) (bool, error) {
+	typ, err := client.Type(ctx, key).Result()
+	if err != nil || typ != "string" {
+		return false, err
+	}
+	v, err := client.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return false, nil
+		}
+		return false, err
+	}
+	r, err := decodeRule(v)
+	return err == nil && !r.Tunnel.IsZero(), nil
+}
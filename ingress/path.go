@@ -0,0 +1,89 @@
+package ingress
+
+import (
+	"context"
+	"path"
+	"strings"
+)
+
+// maximum number of path segments of a path rule
+const maxPathDepth = 8
+
+// splitPath splits a rule host of the form host[:port][/path] into the host and the
+// clean path prefix, empty for the root path. A query string is dropped.
+func splitPath(v string) (host, prefix string) {
+	host, prefix, ok := strings.Cut(v, "/")
+	if !ok {
+		return v, ""
+	}
+	return host, cleanPath(prefix)
+}
+
+// cleanPath returns the canonical form of a path prefix: a leading slash,
+// no trailing slash and no dot segments. The root path is returned as "".
+func cleanPath(p string) string {
+	p, _, _ = strings.Cut(p, "?")
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return ""
+	}
+	return p
+}
+
+// pathDepth returns the number of segments of the path prefix p.
+func pathDepth(p string) int {
+	return strings.Count(p, "/")
+}
+
+// pathCandidates returns the path prefixes that may serve p, longest first and
+// ending with the root path, e.g. "/api/v1" -> ["/api/v1", "/api", ""].
+// Segments beyond maxPathDepth are ignored.
+func pathCandidates(p string) []string {
+	for pathDepth(p) > maxPathDepth {
+		p = p[:strings.LastIndexByte(p, '/')]
+	}
+
+	prefixes := []string{p}
+	for p != "" {
+		p = p[:strings.LastIndexByte(p, '/')]
+		prefixes = append(prefixes, p)
+	}
+	return prefixes
+}
+
+// routeCandidates returns the rule keys that may serve the path p of a host with
+// the rule key key: the path rules of the exact key, longest prefix first,
+// followed by those of each wildcard key.
+func routeCandidates(key, p string) []string {
+	prefixes := pathCandidates(p)
+
+	var keys []string
+	for _, k := range ruleCandidates(key) {
+		for _, prefix := range prefixes {
+			keys = append(keys, k+prefix)
+		}
+	}
+	return keys
+}
+
+// checkPathRule reports whether the tunnel t may claim the new rule key. Path rules
+// under a host rule are reserved for the tunnels serving the host, the owner
+// hands them over to other tunnels with a transfer.
+func (s *server) checkPathRule(ctx context.Context, key string, t tunnel) error {
+	host, prefix := splitPath(key)
+	if prefix == "" {
+		return nil
+	}
+
+	r, err := s.getRule(ctx, s.client, host)
+	if err == ErrRuleNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !r.serves(t) {
+		return ErrRuleOwned
+	}
+	return nil
+}
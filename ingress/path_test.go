@@ -0,0 +1,45 @@
+package ingress
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitPath(t *testing.T) {
+	tests := []struct {
+		v            string
+		host, prefix string
+	}{
+		{"foo.gost.run", "foo.gost.run", ""},
+		{"foo.gost.run/", "foo.gost.run", ""},
+		{"foo.gost.run:8080/api/", "foo.gost.run:8080", "/api"},
+		{"foo.gost.run/api//v1/../v2?q=1", "foo.gost.run", "/api/v2"},
+		{"foo.gost.run/../..", "foo.gost.run", ""},
+	}
+	for _, tt := range tests {
+		host, prefix := splitPath(tt.v)
+		if host != tt.host || prefix != tt.prefix {
+			t.Errorf("splitPath(%q) = %q, %q, want %q, %q", tt.v, host, prefix, tt.host, tt.prefix)
+		}
+	}
+}
+
+func TestRouteCandidates(t *testing.T) {
+	tests := []struct {
+		key, p string
+		want   []string
+	}{
+		{"foo", "", []string{"foo"}},
+		{"foo", "/api", []string{"foo/api", "foo"}},
+		{"a.b", "/api/v1", []string{"a.b/api/v1", "a.b/api", "a.b", "*.b/api/v1", "*.b/api", "*.b"}},
+		{"foo", "/1/2/3/4/5/6/7/8/9/10", []string{
+			"foo/1/2/3/4/5/6/7/8", "foo/1/2/3/4/5/6/7", "foo/1/2/3/4/5/6", "foo/1/2/3/4/5",
+			"foo/1/2/3/4", "foo/1/2/3", "foo/1/2", "foo/1", "foo",
+		}},
+	}
+	for _, tt := range tests {
+		if got := routeCandidates(tt.key, tt.p); !slices.Equal(got, tt.want) {
+			t.Errorf("routeCandidates(%q, %q) = %q, want %q", tt.key, tt.p, got, tt.want)
+		}
+	}
+}
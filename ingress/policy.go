@@ -0,0 +1,221 @@
+package ingress
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrHostReserved is returned when a host is reserved for other tunnels.
+	ErrHostReserved = errors.New("host is reserved")
+	// ErrHostDenied is returned when a host matches a denylist pattern.
+	ErrHostDenied = errors.New("host is not allowed")
+)
+
+// policyConfig is the JSON layout of the policy file:
+//
+//	{
+//	  "reserved": {"www": [], "api": ["<tunnel-id>"]},
+//	  "deny": ["admin*", "re:^login[0-9]*$"],
+//	  "words": ["paypal"]
+//	}
+//
+// Reserved names may only be claimed by the listed tunnels. Deny patterns are
+// globs, or regular expressions when prefixed with "re:". Words are blocked
+// anywhere in a host, including lookalike spellings such as "paypa1".
+type policyConfig struct {
+	Reserved map[string][]string `json:"reserved"`
+	Deny     []string            `json:"deny"`
+	Words    []string            `json:"words"`
+}
+
+type policy struct {
+	reserved map[string][]tunnel
+	globs    []string
+	regexps  []*regexp.Regexp
+	words    []string
+}
+
+func parsePolicy(cfg *policyConfig) (*policy, error) {
+	p := &policy{
+		reserved: make(map[string][]tunnel),
+	}
+
+	for name, ids := range cfg.Reserved {
+		name = strings.ToLower(name)
+		p.reserved[name] = nil
+		for _, id := range ids {
+			t := newTunnel(parseTunnelID(id))
+			if t.IsZero() {
+				return nil, fmt.Errorf("reserved %s: invalid tunnel ID %q", name, id)
+			}
+			p.reserved[name] = append(p.reserved[name], t)
+		}
+	}
+
+	for _, pattern := range cfg.Deny {
+		if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("deny %s: %w", pattern, err)
+			}
+			p.regexps = append(p.regexps, re)
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("deny %s: %w", pattern, err)
+		}
+		p.globs = append(p.globs, strings.ToLower(pattern))
+	}
+
+	for _, word := range cfg.Words {
+		if w := foldLookalike(word); w != "" {
+			p.words = append(p.words, w)
+		}
+	}
+
+	return p, nil
+}
+
+// check reports whether the tunnel t may claim the rule key.
+func (p *policy) check(key string, t tunnel) error {
+	if p == nil {
+		return nil
+	}
+
+	name := strings.ToLower(strings.TrimPrefix(key, "*."))
+
+	if owners, ok := p.reserved[name]; ok {
+		for _, owner := range owners {
+			if owner.Equal(t) {
+				return nil
+			}
+		}
+		return ErrHostReserved
+	}
+
+	for _, glob := range p.globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return ErrHostDenied
+		}
+	}
+	for _, re := range p.regexps {
+		if re.MatchString(name) {
+			return ErrHostDenied
+		}
+	}
+
+	folded := foldLookalike(name)
+	merged := lookalikeSequences.Replace(folded)
+	for _, word := range p.words {
+		if strings.Contains(folded, word) || strings.Contains(merged, word) {
+			return ErrHostDenied
+		}
+	}
+
+	return nil
+}
+
+var lookalikeReplacer = strings.NewReplacer(
+	"0", "o",
+	"1", "i", "l", "i", "!", "i", "|", "i",
+	"3", "e",
+	"4", "a", "@", "a",
+	"5", "s", "$", "s",
+	"7", "t",
+	"8", "b",
+	"9", "g",
+	"-", "", "_", "", ".", "",
+)
+
+// lookalikeSequences folds letter sequences that look like a single letter. They are
+// only folded in hosts, folding them in words too would make "corn" block "company".
+var lookalikeSequences = strings.NewReplacer(
+	"rn", "m",
+	"vv", "w",
+)
+
+// foldLookalike maps s to a canonical spelling so that lookalike
+// variants of a word ("pay-pa1", "PAYPAL") compare equal.
+func foldLookalike(s string) string {
+	return lookalikeReplacer.Replace(strings.ToLower(s))
+}
+
+// policyLoader keeps the policy loaded from a file, reloading it when the file changes.
+type policyLoader struct {
+	file    string
+	modTime time.Time
+	policy  atomic.Pointer[policy]
+}
+
+func newPolicyLoader(file string) (*policyLoader, error) {
+	l := &policyLoader{file: file}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *policyLoader) get() *policy {
+	if l == nil {
+		return nil
+	}
+	return l.policy.Load()
+}
+
+func (l *policyLoader) reload() error {
+	fi, err := os.Stat(l.file)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(l.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(l.file)
+	if err != nil {
+		return err
+	}
+	var cfg policyConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	p, err := parsePolicy(&cfg)
+	if err != nil {
+		return err
+	}
+
+	l.policy.Store(p)
+	l.modTime = fi.ModTime()
+	slog.Info(fmt.Sprintf("policy loaded from %s: %d reserved, %d deny, %d words",
+		l.file, len(p.reserved), len(p.globs)+len(p.regexps), len(p.words)))
+
+	return nil
+}
+
+// run reloads the policy file every interval until ctx is done.
+// A broken file is reported and the previous policy is kept.
+func (l *policyLoader) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.reload(); err != nil {
+				slog.Error(fmt.Sprintf("policy %s: %v", l.file, err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package ingress
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFoldLookalike(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"paypal", "paypai"},
+		{"PAYPAL", "paypai"},
+		{"pay-pa1", "paypai"},
+		{"p@ypa1", "paypai"},
+		{"g00gle", "googie"},
+		{"a.b_c-d", "abcd"},
+		{"corn", "corn"},
+		{"savvy", "savvy"},
+	}
+	for _, tt := range tests {
+		if got := foldLookalike(tt.s); got != tt.want {
+			t.Errorf("foldLookalike(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyWords(t *testing.T) {
+	p, err := parsePolicy(&policyConfig{
+		Words: []string{"paypal", "microsoft", "corn"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key    string
+		denied bool
+	}{
+		{"paypal", true},
+		{"my-paypal-login", true},
+		{"pay-pa1", true},
+		{"PAYPAL.example.com", true},
+		{"*.paypa1", true},
+		{"rnicrosoft", true},
+		{"m1cr0soft", true},
+		{"corn", true},
+		{"c0rn-field", true},
+		{"company", false},
+		{"welcome", false},
+		{"pay", false},
+		{"pal", false},
+		{"microsite", false},
+	}
+	for _, tt := range tests {
+		err := p.check(tt.key, tunnel{})
+		if tt.denied && !errors.Is(err, ErrHostDenied) {
+			t.Errorf("check(%q) = %v, want ErrHostDenied", tt.key, err)
+		}
+		if !tt.denied && err != nil {
+			t.Errorf("check(%q) = %v, want nil", tt.key, err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package ingress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	// ErrQuotaExceeded is returned when a tunnel already owns the maximum number of rules.
+	ErrQuotaExceeded = errors.New("rule quota exceeded")
+)
+
+// quota returns the maximum number of rules the tunnel t may own, zero for no limit.
+func (s *server) quota(t tunnel) int {
+	if t.Private && s.opts.QuotaPrivate > 0 {
+		return s.opts.QuotaPrivate
+	}
+	if !t.Private && s.opts.QuotaPublic > 0 {
+		return s.opts.QuotaPublic
+	}
+	return s.opts.Quota
+}
+
+// checkQuota reports whether the tunnel t may claim another rule.
+func (s *server) checkQuota(ctx context.Context, c redis.Cmdable, t tunnel) error {
+	limit := s.quota(t)
+	if limit <= 0 {
+		return nil
+	}
+
+	keys, _, err := s.indexedRules(ctx, c, t)
+	if err != nil {
+		return err
+	}
+	if len(keys) >= limit {
+		return fmt.Errorf("%w: %d of %d", ErrQuotaExceeded, len(keys), limit)
+	}
+	return nil
+}
+
+// indexRule adds the rule key to the reverse index of its owner.
+func (s *server) indexRule(ctx context.Context, key string, t tunnel) {
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		s.addIndex(ctx, pipe, key, t)
+		return nil
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("index %s -> %s: %v", key, t, err))
+	}
+}
+
+// addIndex queues adding the rule key to the reverse index of the tunnel t. The index
+// expires after the longest rule expiration of all domains, never if rules do not expire:
+// an expiration of zero would delete it.
+func (s *server) addIndex(ctx context.Context, pipe redis.Pipeliner, key string, t tunnel) {
+	tk := s.keys.tunnel(t)
+	pipe.SAdd(ctx, tk, key)
+	if ttl := s.domains.maxTTL(); ttl > 0 {
+		pipe.Expire(ctx, tk, ttl)
+	} else {
+		pipe.Persist(ctx, tk)
+	}
+}
+
+// unindexRule removes the rule key from the reverse index of its former owner.
+func (s *server) unindexRule(ctx context.Context, key string, t tunnel) {
+	if err := s.client.SRem(ctx, s.keys.tunnel(t), key).Err(); err != nil {
+		slog.Error(fmt.Sprintf("unindex %s -> %s: %v", key, t, err))
+	}
+}
+
+// tunnelRules returns the keys of the rules the tunnel t owns or is a member of.
+// Index entries of rules that expired or changed hands are pruned.
+func (s *server) tunnelRules(ctx context.Context, t tunnel) ([]string, error) {
+	owned, stale, err := s.indexedRules(ctx, s.client, t)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stale) > 0 {
+		tk := s.keys.tunnel(t)
+		members := make([]any, len(stale))
+		for i := range stale {
+			members[i] = stale[i]
+		}
+		if err := s.client.SRem(ctx, tk, members...).Err(); err != nil {
+			slog.Error(fmt.Sprintf("prune %s: %v", t, err))
+		}
+	}
+
+	return owned, nil
+}
+
+// indexedRules splits the rule keys in the reverse index of the tunnel t into those
+// of the rules it owns or is a member of and the stale ones, without pruning them.
+func (s *server) indexedRules(ctx context.Context, c redis.Cmdable, t tunnel) (owned, stale []string, err error) {
+	keys, err := c.SMembers(ctx, s.keys.tunnel(t)).Result()
+	if err != nil || len(keys) == 0 {
+		return nil, nil, err
+	}
+
+	vs, err := c.MGet(ctx, s.keys.rules(keys)...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, v := range vs {
+		if sv, _ := v.(string); sv != "" {
+			if r, err := decodeRule(sv); err == nil && r.serves(t) {
+				owned = append(owned, keys[i])
+				continue
+			}
+		}
+		stale = append(stale, keys[i])
+	}
+	return owned, stale, nil
+}
+
+// insertRule stores the new rule r under key with expiration and indexes it, unless
+// the key is taken or the tunnel of r exceeds its quota. The quota is checked in the
+// same transaction, watching the reverse index of the tunnel, so that concurrent
+// claims of a tunnel cannot exceed it together. It reports whether r was stored.
+func (s *server) insertRule(ctx context.Context, key string, r *rule, expiration time.Duration) (ok bool, err error) {
+	v, err := r.encode()
+	if err != nil {
+		return false, err
+	}
+
+	rk, tk := s.keys.rule(key), s.keys.tunnel(r.Tunnel)
+	for i := 0; i < updateAttempts; i++ {
+		err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+			ok = false
+			n, err := tx.Exists(ctx, rk).Result()
+			if err != nil || n > 0 {
+				return err
+			}
+			if err := s.checkQuota(ctx, tx, r.Tunnel); err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, rk, v, expiration)
+				s.addIndex(ctx, pipe, key, r.Tunnel)
+				return nil
+			})
+			ok = err == nil
+			return err
+		}, rk, tk)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	return ok, err
+}
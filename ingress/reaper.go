@@ -0,0 +1,115 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// touch records the rule key as seen now. Last-seen times are only tracked
+// when the reaper is enabled.
+func (s *server) touch(ctx context.Context, key string) {
+	if s.opts.IdleTimeout <= 0 {
+		return
+	}
+	z := &redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: key,
+	}
+	if err := s.client.ZAdd(ctx, s.keys.seen(), z).Err(); err != nil {
+		slog.Error(fmt.Sprintf("touch %s: %v", key, err))
+	}
+}
+
+// forget drops the last-seen record of the rule key.
+func (s *server) forget(ctx context.Context, key string) {
+	if s.opts.IdleTimeout <= 0 {
+		return
+	}
+	if err := s.client.ZRem(ctx, s.keys.seen(), key).Err(); err != nil {
+		slog.Error(fmt.Sprintf("forget %s: %v", key, err))
+	}
+}
+
+// runReaper periodically frees the rules that have not been refreshed within Options.IdleTimeout.
+func (s *server) runReaper(ctx context.Context) {
+	interval := s.opts.ReapInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.reap(ctx); err != nil {
+				slog.Error(fmt.Sprintf("reap: %v", err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *server) reap(ctx context.Context) error {
+	deadline := time.Now().Add(-s.opts.IdleTimeout).Unix()
+	keys, err := s.client.ZRangeByScore(ctx, s.keys.seen(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(deadline, 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		// an owner refreshing the rule touches it before extending the expiration,
+		// which modifies the watched last-seen times and aborts the transaction.
+		var cur *rule
+		reaped := false
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			seen, err := tx.ZScore(ctx, s.keys.seen(), key).Result()
+			if err != nil {
+				if err == redis.Nil {
+					return nil
+				}
+				return err
+			}
+			if int64(seen) > deadline {
+				return nil
+			}
+			if cur, err = s.getRule(ctx, tx, key); err != nil && err != ErrRuleNotFound {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, s.keys.rule(key))
+				pipe.ZRem(ctx, s.keys.seen(), key)
+				return nil
+			})
+			reaped = err == nil
+			return err
+		}, s.keys.rule(key), s.keys.seen())
+		if err != nil {
+			if err != redis.TxFailedErr {
+				slog.Error(fmt.Sprintf("reap %s: %v", key, err))
+			}
+			continue
+		}
+		// a last-seen record without a rule is dropped silently.
+		if reaped && cur != nil {
+			slog.Info(fmt.Sprintf("reap: %s -> %s", key, cur.Tunnel))
+			s.unindexRule(ctx, key, cur.Tunnel)
+			for _, m := range cur.Members {
+				s.unindexRule(ctx, key, m.Tunnel)
+			}
+			s.publish(ctx, EventReap, key, cur, cur.Tunnel)
+		}
+	}
+
+	return nil
+}
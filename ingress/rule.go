@@ -0,0 +1,376 @@
+package ingress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrRuleOwned is returned when a host is bound to another tunnel.
+	ErrRuleOwned = errors.New("host is owned by another tunnel")
+	// ErrRuleNotFound is returned when no rule exists for a host.
+	ErrRuleNotFound = errors.New("rule not found")
+	// ErrNotMember is returned when a tunnel is neither the owner nor a member of a rule.
+	ErrNotMember = errors.New("tunnel is not a member")
+	// ErrRuleDomain is returned when a host prefix is already claimed under another domain.
+	ErrRuleDomain = errors.New("host prefix is claimed under another domain")
+)
+
+// attempts of an optimistic rule update before giving up
+const updateAttempts = 3
+
+// ruleStatus converts a rule ownership error into a gRPC status error.
+func ruleStatus(key string, err error) error {
+	switch {
+	case errors.Is(err, ErrRuleOwned), errors.Is(err, ErrRuleDomain):
+		return status.Error(codes.AlreadyExists, fmt.Sprintf("%s: %v", key, err))
+	case errors.Is(err, ErrRuleNotFound), errors.Is(err, ErrNotMember):
+		return status.Error(codes.NotFound, fmt.Sprintf("%s: %v", key, err))
+	case errors.Is(err, ErrQuotaExceeded), errors.Is(err, ErrAllocExhausted):
+		return status.Error(codes.ResourceExhausted, fmt.Sprintf("%s: %v", key, err))
+	case errors.Is(err, ErrDomainUnverified):
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("%s: %v", key, err))
+	case errors.Is(err, ErrCustomDenied), errors.Is(err, ErrPrivateDenied):
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("%s: %v", key, err))
+	case errors.Is(err, ErrInvalidStrategy), errors.Is(err, ErrHostInvalid):
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("%s: %v", key, err))
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// getRule reads the rule stored under key.
+func (s *server) getRule(ctx context.Context, c redis.Cmdable, key string) (*rule, error) {
+	v, err := c.Get(ctx, s.keys.rule(key)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrRuleNotFound
+		}
+		return nil, err
+	}
+	return decodeRule(v)
+}
+
+// updateRule atomically modifies the rule stored under key with fn. The rule expiration
+// is reset to the expiration of its domain if refresh is set and kept otherwise.
+func (s *server) updateRule(ctx context.Context, key string, refresh bool, fn func(r *rule) error) (err error) {
+	for i := 0; i < updateAttempts; i++ {
+		err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+			r, err := s.getRule(ctx, tx, key)
+			if err != nil {
+				return err
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+			v, err := r.encode()
+			if err != nil {
+				return err
+			}
+			var expiration time.Duration = redis.KeepTTL
+			if refresh {
+				expiration = s.expiration(r)
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, s.keys.rule(key), v, expiration)
+				return nil
+			})
+			return err
+		}, s.keys.rule(key))
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
+}
+
+// claim binds the rule key to the tunnel of r. Claiming a rule the tunnel already owns
+// or is a member of refreshes it, a rule owned by another tunnel is rejected with ErrRuleOwned.
+func (s *server) claim(ctx context.Context, key string, r *rule) error {
+	cur, err := s.getRule(ctx, s.client, key)
+	if err != nil && err != ErrRuleNotFound {
+		return err
+	}
+	if cur != nil {
+		if !cur.serves(r.Tunnel) {
+			return ErrRuleOwned
+		}
+		if !s.servesDomain(cur, r.Domain) {
+			return ErrRuleDomain
+		}
+		if err := s.refresh(ctx, key, cur, r); err != ErrRuleNotFound {
+			return err
+		}
+		// expired or reaped in between, claim it anew.
+		s.forget(ctx, key)
+	}
+
+	if !s.domains.get(r.Domain).custom {
+		return ErrCustomDenied
+	}
+	if err := s.checkPathRule(ctx, key, r.Tunnel); err != nil {
+		return err
+	}
+	ok, err := s.insertRule(ctx, key, r, s.expiration(r))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// claimed in between, try again.
+		return s.claim(ctx, key, r)
+	}
+	s.touch(ctx, key)
+	s.publish(ctx, EventClaim, key, r, r.Tunnel)
+
+	slog.Debug(fmt.Sprintf("claim: %s -> %s", key, r.Tunnel))
+	return nil
+}
+
+// checkLegacyRule reports whether the tunnel t may claim the name key under a domain
+// other than the default one. Rules of older versions were keyed by the name alone
+// and served it under all domains, until they expire the name stays with their tunnels.
+func (s *server) checkLegacyRule(ctx context.Context, key string, t tunnel) error {
+	r, err := s.getRule(ctx, s.client, key)
+	if err == ErrRuleNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.Domain == "" && !r.Custom && !r.serves(t) {
+		return ErrRuleOwned
+	}
+	return nil
+}
+
+// refresh slides the expiration of the rule cur on behalf of its owner or one of
+// its members, r is the rule the tunnel asked for. It returns ErrRuleNotFound
+// if the rule is gone in the meantime.
+func (s *server) refresh(ctx context.Context, key string, cur, r *rule) (err error) {
+	// touching first aborts a concurrent reap of the rule, which watches the last-seen times.
+	s.touch(ctx, key)
+
+	if len(cur.Members) == 0 && (cur.Verified || !r.Verified) {
+		var ok bool
+		ok, err = s.client.Expire(ctx, s.keys.rule(key), s.expiration(cur)).Result()
+		if err == nil && !ok {
+			err = ErrRuleNotFound
+		}
+	} else {
+		var lapsed []member
+		err = s.updateRule(ctx, key, true, func(cur *rule) error {
+			if !cur.serves(r.Tunnel) {
+				return ErrRuleOwned
+			}
+			if r.Verified && cur.Tunnel.Equal(r.Tunnel) {
+				cur.Verified = true
+			}
+			if m := cur.member(r.Tunnel); m != nil {
+				m.Renew = time.Now().Unix()
+			}
+			lapsed = cur.prune(s.expiration(cur))
+			return nil
+		})
+		for _, m := range lapsed {
+			s.unindexRule(ctx, key, m.Tunnel)
+			s.publish(ctx, EventLeave, key, cur, m.Tunnel)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.indexRule(ctx, key, r.Tunnel)
+	s.publish(ctx, EventRefresh, key, cur, r.Tunnel)
+
+	slog.Debug(fmt.Sprintf("refresh: %s -> %s", key, r.Tunnel))
+	return nil
+}
+
+// release deletes the rule key if it is owned by t, or removes t from its members.
+// A zero t releases the rule regardless of its owner.
+func (s *server) release(ctx context.Context, key string, t tunnel) error {
+	if !t.IsZero() {
+		r, err := s.getRule(ctx, s.client, key)
+		if err != nil {
+			return err
+		}
+		if !r.Tunnel.Equal(t) {
+			if r.member(t) == nil {
+				return ErrRuleOwned
+			}
+			return s.removeMember(ctx, key, tunnel{}, t)
+		}
+	}
+
+	return s.client.Watch(ctx, func(tx *redis.Tx) error {
+		r, err := s.getRule(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if !t.IsZero() && !r.Tunnel.Equal(t) {
+			return ErrRuleOwned
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, s.keys.rule(key))
+			return nil
+		})
+		if err == nil {
+			slog.Info(fmt.Sprintf("release: %s -> %s", key, r.Tunnel))
+			s.forget(ctx, key)
+			s.unindexRule(ctx, key, r.Tunnel)
+			for _, m := range r.Members {
+				s.unindexRule(ctx, key, m.Tunnel)
+			}
+			s.publish(ctx, EventRelease, key, r, r.Tunnel)
+		}
+		return err
+	}, s.keys.rule(key))
+}
+
+// transfer hands the rule key over from one tunnel to another, keeping its expiration.
+// The new owner also takes the place of the old one among the members.
+// Unless force is set, the rule must exist and be owned by from.
+// A forced transfer also creates the rule if it does not exist, under domain.
+func (s *server) transfer(ctx context.Context, key, domain string, from, to tunnel, force bool) error {
+	rk := s.keys.rule(key)
+	return s.client.Watch(ctx, func(tx *redis.Tx) error {
+		r, err := s.getRule(ctx, tx, key)
+		if err != nil && !(force && err == ErrRuleNotFound) {
+			return err
+		}
+		exists := err == nil
+		if !exists {
+			r = newRule(to)
+			r.Domain = domain
+			r.Custom = domain == ""
+		}
+		if !force && !r.Tunnel.Equal(from) {
+			return ErrRuleOwned
+		}
+		if !exists || !r.serves(to) {
+			if err := s.checkQuota(ctx, tx, to); err != nil {
+				return err
+			}
+		}
+
+		owner := r.Tunnel
+		r.Tunnel = to
+		if r.member(owner) != nil && !owner.Equal(to) {
+			r.Members = slices.DeleteFunc(r.Members, func(m member) bool { return m.Tunnel.Equal(to) })
+			m := r.member(owner)
+			m.Tunnel = to
+			m.Renew = time.Now().Unix()
+		}
+		v, err := r.encode()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if exists {
+				pipe.Set(ctx, rk, v, redis.KeepTTL)
+			} else {
+				pipe.Set(ctx, rk, v, s.expiration(r))
+			}
+			s.addIndex(ctx, pipe, key, to)
+			return nil
+		})
+		if err == nil {
+			slog.Info(fmt.Sprintf("transfer: %s -> %s -> %s, force=%v", key, owner, to, force))
+			s.touch(ctx, key)
+			if exists && !r.serves(owner) {
+				s.unindexRule(ctx, key, owner)
+			}
+			s.publish(ctx, EventTransfer, key, r, to)
+		}
+		return err
+	}, rk, s.keys.tunnel(to))
+}
+
+// addMember adds the tunnel m to the members serving the rule key, or updates its weight,
+// and sets the balance strategy of the rule if strategy is not empty.
+// Unless owner is zero, the rule must be owned by owner. The owner joins the members
+// with the default weight when the first member is added.
+func (s *server) addMember(ctx context.Context, key string, owner tunnel, m member, strategy string) error {
+	if !validStrategy(strategy) {
+		return ErrInvalidStrategy
+	}
+
+	r, err := s.getRule(ctx, s.client, key)
+	if err != nil {
+		return err
+	}
+	if !r.serves(m.Tunnel) {
+		if err := s.checkQuota(ctx, s.client, m.Tunnel); err != nil {
+			return err
+		}
+	}
+
+	err = s.updateRule(ctx, key, false, func(r *rule) error {
+		if !owner.IsZero() && !r.Tunnel.Equal(owner) {
+			return ErrRuleOwned
+		}
+
+		now := time.Now().Unix()
+		if len(r.Members) == 0 {
+			r.Members = append(r.Members, member{Tunnel: r.Tunnel, Renew: now})
+		}
+		if cur := r.member(m.Tunnel); cur != nil {
+			cur.Weight = m.Weight
+		} else {
+			m.Renew = now
+			r.Members = append(r.Members, m)
+		}
+		if strategy != "" {
+			r.Strategy = strategy
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.indexRule(ctx, key, m.Tunnel)
+	s.publish(ctx, EventJoin, key, r, m.Tunnel)
+
+	slog.Info(fmt.Sprintf("member: %s + %s, weight=%d", key, m.Tunnel, m.Weight))
+	return nil
+}
+
+// removeMember removes the tunnel t from the members serving the rule key.
+// Unless owner is zero, the rule must be owned by owner. The owner itself cannot be removed.
+func (s *server) removeMember(ctx context.Context, key string, owner, t tunnel) error {
+	var cur *rule
+	err := s.updateRule(ctx, key, false, func(r *rule) error {
+		cur = r
+		if !owner.IsZero() && !r.Tunnel.Equal(owner) {
+			return ErrRuleOwned
+		}
+		if r.Tunnel.Equal(t) || r.member(t) == nil {
+			return ErrNotMember
+		}
+		r.Members = slices.DeleteFunc(r.Members, func(m member) bool { return m.Tunnel.Equal(t) })
+		if len(r.Members) == 1 {
+			// the owner is left alone.
+			r.Members = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.unindexRule(ctx, key, t)
+	s.publish(ctx, EventLeave, key, cur, t)
+
+	slog.Info(fmt.Sprintf("member: %s - %s", key, t))
+	return nil
+}
@@ -0,0 +1,95 @@
+package ingress
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-gost/relay"
+)
+
+// tunnel is the canonical form of a tunnel ID stored in a rule.
+type tunnel struct {
+	// lowercase UUID of the tunnel
+	ID      string `json:"id"`
+	Private bool   `json:"private,omitempty"`
+	// extra information supplied when the rule was claimed, e.g. the service name
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func newTunnel(tid relay.TunnelID) tunnel {
+	if tid.IsZero() {
+		return tunnel{}
+	}
+	return tunnel{
+		ID:      tid.String(),
+		Private: tid.IsPrivate(),
+	}
+}
+
+func (t tunnel) IsZero() bool {
+	return t.ID == ""
+}
+
+// Equal reports whether t and x identify the same tunnel.
+func (t tunnel) Equal(x tunnel) bool {
+	return !t.IsZero() && t.ID == x.ID
+}
+
+// String returns the endpoint representation of t, private tunnels are prefixed with '$'.
+func (t tunnel) String() string {
+	if t.Private {
+		return "$" + t.ID
+	}
+	return t.ID
+}
+
+// rule is the value stored in Redis for an ingress rule.
+type rule struct {
+	Tunnel tunnel `json:"tunnel"`
+	// creation time
+	Created int64 `json:"created"`
+	// the custom domain passed its ownership challenge
+	Verified bool `json:"verified,omitempty"`
+	// tunnels serving the host, including the owner, empty if the owner serves it alone
+	Members []member `json:"members,omitempty"`
+	// balance strategy across members, Options.Balance if empty
+	Strategy string `json:"strategy,omitempty"`
+	// the domain the rule was claimed under, empty for custom domains
+	Domain string `json:"domain,omitempty"`
+	// claimed for a host outside of all domains, unset by older versions
+	Custom bool `json:"custom,omitempty"`
+}
+
+func newRule(t tunnel) *rule {
+	return &rule{
+		Tunnel:  t,
+		Created: time.Now().Unix(),
+	}
+}
+
+func (r *rule) encode() (string, error) {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
+
+// decodeRule parses a stored rule.
+// Rules written by older versions hold a bare tunnel ID string.
+func decodeRule(v string) (*rule, error) {
+	if !strings.HasPrefix(v, "{") {
+		return &rule{Tunnel: newTunnel(parseTunnelID(v))}, nil
+	}
+
+	r := &rule{}
+	if err := json.Unmarshal([]byte(v), r); err != nil {
+		return nil, err
+	}
+	r.Tunnel.ID = strings.ToLower(r.Tunnel.ID)
+	for i := range r.Members {
+		r.Members[i].Tunnel.ID = strings.ToLower(r.Members[i].Tunnel.ID)
+	}
+	return r, nil
+}
@@ -0,0 +1,59 @@
+package ingress
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeRule(t *testing.T) {
+	const id = "3f2504e0-4f89-41d3-9a0c-0305e82c3301"
+
+	tests := []struct {
+		v    string
+		want *rule
+		err  bool
+	}{
+		// bare tunnel IDs stored by older versions
+		{id, &rule{Tunnel: tunnel{ID: id}}, false},
+		{"3F2504E0-4F89-41D3-9A0C-0305E82C3301", &rule{Tunnel: tunnel{ID: id}}, false},
+		{"$" + id, &rule{Tunnel: tunnel{ID: id, Private: true}}, false},
+		{"not-a-uuid", &rule{}, false},
+		{"", &rule{}, false},
+		// JSON rules
+		{`{"tunnel":{"id":"` + id + `"},"created":1700000000}`, &rule{Tunnel: tunnel{ID: id}, Created: 1700000000}, false},
+		{`{"tunnel":{"id":"3F2504E0-4F89-41D3-9A0C-0305E82C3301","private":true},"members":[{"tunnel":{"id":"ABC"},"weight":2}]}`,
+			&rule{Tunnel: tunnel{ID: id, Private: true}, Members: []member{{Tunnel: tunnel{ID: "abc"}, Weight: 2}}}, false},
+		{`{"tunnel":{"id":"` + id + `"},"domain":"gost.run"}`, &rule{Tunnel: tunnel{ID: id}, Domain: "gost.run"}, false},
+		{`{"tunnel":`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := decodeRule(tt.v)
+		if tt.err {
+			if err == nil {
+				t.Errorf("decodeRule(%q) = %+v, want an error", tt.v, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodeRule(%q) = %+v, %v, want %+v", tt.v, got, err, tt.want)
+		}
+	}
+}
+
+func TestEncodeRule(t *testing.T) {
+	r := &rule{
+		Tunnel:   tunnel{ID: "3f2504e0-4f89-41d3-9a0c-0305e82c3301", Private: true},
+		Created:  1700000000,
+		Members:  []member{{Tunnel: tunnel{ID: "3f2504e0-4f89-41d3-9a0c-0305e82c3302"}, Weight: 3, Renew: 1700000001}},
+		Strategy: BalanceHash,
+		Domain:   "gost.run",
+	}
+	v, err := r.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeRule(v)
+	if err != nil || !reflect.DeepEqual(got, r) {
+		t.Errorf("decodeRule(encode(%+v)) = %+v, %v", r, got, err)
+	}
+}
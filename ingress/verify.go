@@ -0,0 +1,223 @@
+package ingress
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// DNS TXT record name prefix and HTTP path of a custom domain challenge.
+	challengeTXTPrefix  = "_gost-challenge."
+	challengeHTTPPrefix = "/.well-known/gost-challenge/"
+
+	defaultChallengeExpiration = 24 * time.Hour
+)
+
+var (
+	// ErrDomainUnverified is returned when a custom domain has not passed its ownership challenge yet.
+	ErrDomainUnverified = errors.New("domain is not verified")
+)
+
+// Resolver looks up the DNS TXT records of custom domain challenges.
+// net.DefaultResolver is used when Options.Resolver is nil.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// customDomain reports whether the rule key for host is a custom domain,
+// i.e. a multi-label host that is not under one of Options.Domains.
+func customDomain(host, key string) bool {
+	return key == host && strings.Contains(strings.TrimPrefix(key, "*."), ".")
+}
+
+// checkCustomDomain rejects a custom domain that is an IP literal or has a numeric
+// top-level label, so that its challenges never reach an arbitrary address.
+func checkCustomDomain(domain string) error {
+	if net.ParseIP(domain) != nil {
+		return fmt.Errorf("%w: IP address", ErrHostInvalid)
+	}
+	tld := domain[strings.LastIndexByte(domain, '.')+1:]
+	if strings.Trim(tld, "0123456789") == "" {
+		return fmt.Errorf("%w: numeric top-level domain", ErrHostInvalid)
+	}
+	return nil
+}
+
+// verify checks that the tunnel of r controls the custom domain key and marks r verified.
+// Rules already verified for the tunnel stay verified. Otherwise a challenge token is
+// issued and the returned error tells the client how to publish it, either as a DNS TXT
+// record or, for non-wildcard domains, over HTTP on the domain itself.
+func (s *server) verify(ctx context.Context, key string, r *rule) error {
+	domain, wildcard := strings.CutPrefix(key, "*.")
+	if err := checkCustomDomain(domain); err != nil {
+		return err
+	}
+
+	if cur, err := s.getRule(ctx, s.client, key); err == nil && cur.Verified && cur.Tunnel.Equal(r.Tunnel) {
+		r.Verified = true
+		return nil
+	}
+
+	token, err := s.challengeToken(ctx, key, r.Tunnel)
+	if err != nil {
+		return err
+	}
+
+	if s.lookupChallenge(ctx, domain, token) || (!wildcard && s.fetchChallenge(ctx, domain, token)) {
+		r.Verified = true
+		if err := s.client.Del(ctx, s.keys.challenge(key, r.Tunnel)).Err(); err != nil {
+			slog.Error(fmt.Sprintf("challenge %s: %v", key, err))
+		}
+		slog.Info(fmt.Sprintf("verify: %s -> %s", key, r.Tunnel))
+		return nil
+	}
+
+	if wildcard {
+		return fmt.Errorf("%w: add a TXT record %s%s with value %s",
+			ErrDomainUnverified, challengeTXTPrefix, domain, token)
+	}
+	return fmt.Errorf("%w: add a TXT record %s%s with value %s or serve it at http://%s%s%s",
+		ErrDomainUnverified, challengeTXTPrefix, domain, token, domain, challengeHTTPPrefix, token)
+}
+
+// challengeToken returns the pending challenge token of the tunnel t for key, issuing a new one if needed.
+func (s *server) challengeToken(ctx context.Context, key string, t tunnel) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	expiration := s.opts.ChallengeExpiration
+	if expiration <= 0 {
+		expiration = defaultChallengeExpiration
+	}
+
+	ck := s.keys.challenge(key, t)
+	ok, err := s.client.SetNX(ctx, ck, token, expiration).Result()
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		slog.Debug(fmt.Sprintf("challenge: %s -> %s", key, t))
+		return token, nil
+	}
+
+	token, err = s.client.Get(ctx, ck).Result()
+	if err == redis.Nil {
+		return s.challengeToken(ctx, key, t)
+	}
+	return token, err
+}
+
+func (s *server) lookupChallenge(ctx context.Context, domain, token string) bool {
+	resolver := s.opts.Resolver
+	if resolver == nil {
+		resolver = defaultResolver
+	}
+
+	txts, err := resolver.LookupTXT(ctx, challengeTXTPrefix+domain)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("challenge %s: %v", domain, err))
+		return false
+	}
+	return slices.Contains(txts, token)
+}
+
+func (s *server) fetchChallenge(ctx context.Context, domain, token string) bool {
+	client := s.opts.HTTPClient
+	if client == nil {
+		client = defaultHTTPClient
+	}
+
+	// the challenge must be served by the domain itself, not wherever it redirects to.
+	c := *client
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return errChallengeRedirect
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+domain+challengeHTTPPrefix+token, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("challenge %s: %v", domain, err))
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(body)) == token
+}
+
+var (
+	defaultResolver   Resolver = net.DefaultResolver
+	defaultHTTPClient          = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 5 * time.Second,
+				Control: checkDialAddress,
+			}).DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+
+	errChallengeRedirect = errors.New("challenge: redirects are not followed")
+	errChallengeAddress  = errors.New("challenge: address not allowed")
+)
+
+// checkDialAddress refuses to connect HTTP challenges to loopback, private, link-local
+// and other non-public addresses, which a custom domain may resolve to.
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(ap.Addr()) {
+		return fmt.Errorf("%w: %s", errChallengeAddress, address)
+	}
+	return nil
+}
+
+// non-public ranges not covered by the netip.Addr predicates:
+// "this network" and the carrier-grade NAT range of RFC 6598.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// publicAddr reports whether ip is a public unicast address.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range reservedPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package ingress
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// testResolver answers TXT lookups from a map instead of the DNS.
+type testResolver map[string][]string
+
+func (r testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := r[name]; ok {
+		return txts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestCheckCustomDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		valid  bool
+	}{
+		{"example.com", true},
+		{"foo.example.co.uk", true},
+		{"xn--bcher-kva.example", true},
+		{"1.example.com", true},
+		{"example.x1", true},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"10.0.0.1", false},
+		{"::1", false},
+		{"foo.123", false},
+		{"0x7f.0.0.1", false},
+	}
+	for _, tt := range tests {
+		err := checkCustomDomain(tt.domain)
+		if tt.valid && err != nil {
+			t.Errorf("checkCustomDomain(%q) = %v, want nil", tt.domain, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrHostInvalid) {
+			t.Errorf("checkCustomDomain(%q) = %v, want ErrHostInvalid", tt.domain, err)
+		}
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.public {
+			t.Errorf("publicAddr(%s) = %v, want %v", tt.addr, got, tt.public)
+		}
+	}
+}
+
+func TestLookupChallenge(t *testing.T) {
+	s := &server{opts: &Options{
+		Resolver: testResolver{
+			"_gost-challenge.example.com": {"other", "token"},
+			"_gost-challenge.wrong.com":   {"other"},
+		},
+	}}
+
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com", true},
+		{"wrong.com", false},
+		{"missing.com", false},
+	}
+	for _, tt := range tests {
+		if got := s.lookupChallenge(context.Background(), tt.domain, "token"); got != tt.want {
+			t.Errorf("lookupChallenge(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestFetchChallenge(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/gost-challenge/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "redirect.example.com" {
+			http.Redirect(w, r, "http://example.com/.well-known/gost-challenge/token", http.StatusFound)
+			return
+		}
+		if r.Host == "wrong.example.com" {
+			w.Write([]byte("other"))
+			return
+		}
+		w.Write([]byte("token\n"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// a client reaching the test server whatever the domain resolves to.
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+			},
+		},
+	}
+	s := &server{opts: &Options{HTTPClient: client}}
+
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com", true},
+		{"wrong.example.com", false},
+		{"redirect.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := s.fetchChallenge(context.Background(), tt.domain, "token"); got != tt.want {
+			t.Errorf("fetchChallenge(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+
+	// the default client refuses to connect to the loopback test server.
+	s = &server{opts: &Options{}}
+	if s.fetchChallenge(context.Background(), ts.Listener.Addr().String(), "token") {
+		t.Errorf("fetchChallenge(%s) with the default client succeeded", ts.Listener.Addr())
+	}
+}
@@ -0,0 +1,69 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// MigrateKeys moves the keys stored in the unprefixed layout of older versions into
+// namespace: the internal records under legacyRoot keep their name below namespace,
+// other keys outside of "gost:" are moved to the key returned by target, unless it
+// returns an empty key. With dryRun set, the keys to move are only logged.
+// Keys already present in the namespace are left untouched.
+func MigrateKeys(ctx context.Context, client *redis.Client, namespace, legacyRoot string, target func(ctx context.Context, key string) (string, error), dryRun bool) error {
+	moved, skipped := 0, 0
+
+	iter := client.Scan(ctx, 0, "*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if strings.HasPrefix(key, namespace+":") {
+			continue
+		}
+
+		var to string
+		if name, ok := strings.CutPrefix(key, legacyRoot+":"); ok {
+			to = namespace + ":" + name
+		} else if strings.HasPrefix(key, "gost:") {
+			continue
+		} else {
+			var err error
+			if to, err = target(ctx, key); err != nil {
+				return err
+			}
+			if to == "" {
+				continue
+			}
+		}
+
+		if dryRun {
+			slog.Info(fmt.Sprintf("migrate: %s -> %s (dry run)", key, to))
+			moved++
+			continue
+		}
+		ok, err := client.RenameNX(ctx, key, to).Result()
+		if err != nil {
+			if strings.Contains(err.Error(), "no such key") {
+				// expired while migrating
+				continue
+			}
+			return err
+		}
+		if !ok {
+			slog.Warn(fmt.Sprintf("migrate: %s -> %s: target exists, skipped", key, to))
+			skipped++
+			continue
+		}
+		slog.Info(fmt.Sprintf("migrate: %s -> %s", key, to))
+		moved++
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	slog.Info(fmt.Sprintf("migrate: %d keys moved, %d skipped", moved, skipped))
+	return nil
+}
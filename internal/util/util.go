@@ -0,0 +1,45 @@
+// Package util holds the helpers shared by the ingress and sd plugins.
+package util
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// EscapeGlob escapes the special characters of Redis glob patterns in s.
+func EscapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// WriteJSON writes v as the JSON body of a response with status code.
+func WriteJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Authorized reports whether the admin request r may read with the admin token:
+// always if token is empty, otherwise if r carries it (Authorization: Bearer <token>).
+func Authorized(r *http.Request, token string) bool {
+	return token == "" || IsAdmin(r, token)
+}
+
+// IsAdmin reports whether the admin request r carries the admin token, which is
+// required for privileged operations: they are disabled if token is empty.
+func IsAdmin(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	v, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(v), []byte(token)) == 1
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEscapeGlob(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"", ""},
+		{"foo.gost.run", "foo.gost.run"},
+		{"*.gost.run", `\*.gost.run`},
+		{"a?b", `a\?b`},
+		{"[ab]", `\[ab\]`},
+		{`a\b`, `a\\b`},
+		{"bücher", "bücher"},
+	}
+	for _, tt := range tests {
+		if got := EscapeGlob(tt.s); got != tt.want {
+			t.Errorf("EscapeGlob(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	tests := []struct {
+		token, header     string
+		authorized, admin bool
+	}{
+		{"", "", true, false},
+		{"", "Bearer ", true, false},
+		{"", "Bearer secret", true, false},
+		{"secret", "", false, false},
+		{"secret", "Bearer secret", true, true},
+		{"secret", "Bearer other", false, false},
+		{"secret", "secret", false, false},
+		{"secret", "Basic secret", false, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if got := Authorized(r, tt.token); got != tt.authorized {
+			t.Errorf("Authorized(%q, %q) = %v, want %v", tt.header, tt.token, got, tt.authorized)
+		}
+		if got := IsAdmin(r, tt.token); got != tt.admin {
+			t.Errorf("IsAdmin(%q, %q) = %v, want %v", tt.header, tt.token, got, tt.admin)
+		}
+	}
+}
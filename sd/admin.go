@@ -0,0 +1,219 @@
+package sd
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/ginuerzh/gost-plugins/internal/util"
+)
+
+type adminReportRequest struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+type adminStatsReply struct {
+	Renew *RenewStats `json:"renew"`
+}
+
+type adminListReply struct {
+	Services []ServiceInfo `json:"services"`
+	// cursor of the next page, "0" when the listing is complete
+	Cursor string `json:"cursor"`
+}
+
+type adminReply struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// adminServer exposes the service catalog and the health of service instances over HTTP:
+//
+//	GET    /services?prefix=<p>&cursor=<c>&count=<n>  list service names with their instance counts
+//	GET    /services/{name}/instances               instances of a service with their renew age and metadata
+//	DELETE /services/{name}/instances/{id}          force deregister an instance
+//	GET    /services/{name}/health                  health records of the instances of a service
+//	POST   /services/{name}/instances/{id}/report   report the outcome of a connection to an instance
+//	GET    /services/{name}/watch                   long-poll or stream (text/event-stream) instance changes
+//	GET    /stats                                   counters of renewals of missing instances
+//
+// With Options.AdminToken set, requests must carry it (Authorization: Bearer <token>).
+// Force deregistration and reports are only served with Options.AdminToken set.
+type adminServer struct {
+	srv *server
+}
+
+func listenAndServeAdmin(addr string, srv *server) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("admin server listening on %v", ln.Addr()))
+
+	s := &adminServer{srv: srv}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /services", s.list)
+	mux.HandleFunc("GET /services/{name}/instances", s.instances)
+	mux.HandleFunc("DELETE /services/{name}/instances/{id}", s.deregister)
+	mux.HandleFunc("GET /services/{name}/health", s.health)
+	mux.HandleFunc("POST /services/{name}/instances/{id}/report", s.report)
+	mux.HandleFunc("GET /services/{name}/watch", s.watch)
+	mux.HandleFunc("GET /stats", s.stats)
+
+	return (&http.Server{Handler: s.authorize(mux)}).Serve(ln)
+}
+
+func (s *adminServer) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !util.Authorized(r, s.srv.opts.AdminToken) {
+			writeAdminReply(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isAdmin reports whether the request carries Options.AdminToken, which must be set.
+func (s *adminServer) isAdmin(r *http.Request) bool {
+	return util.IsAdmin(r, s.srv.opts.AdminToken)
+}
+
+func (s *adminServer) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	cursor, err := strconv.ParseUint(cmp.Or(q.Get("cursor"), "0"), 10, 64)
+	if err != nil {
+		writeAdminReply(w, http.StatusBadRequest, fmt.Errorf("invalid cursor: %w", err))
+		return
+	}
+	count, err := strconv.ParseInt(cmp.Or(q.Get("count"), "100"), 10, 64)
+	if err != nil || count <= 0 || count > 1000 {
+		writeAdminReply(w, http.StatusBadRequest, errors.New("invalid count, must be 1-1000"))
+		return
+	}
+
+	services, next, err := s.srv.listServices(r.Context(), cursor, count, q.Get("prefix"))
+	if err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, err)
+		return
+	}
+	util.WriteJSON(w, http.StatusOK, adminListReply{
+		Services: services,
+		Cursor:   strconv.FormatUint(next, 10),
+	})
+}
+
+func (s *adminServer) instances(w http.ResponseWriter, r *http.Request) {
+	instances, err := s.srv.listInstances(r.Context(), r.PathValue("name"))
+	if err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, err)
+		return
+	}
+	util.WriteJSON(w, http.StatusOK, instances)
+}
+
+// deregister removes an instance regardless of its owner and generation.
+// Its renewals do not recreate it until it registers again.
+func (s *adminServer) deregister(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		writeAdminReply(w, http.StatusForbidden, errors.New("admin token required"))
+		return
+	}
+
+	ctx := r.Context()
+	name, id := r.PathValue("name"), r.PathValue("id")
+
+	// marked before the removal, so that a renewal in between does not recreate it
+	if err := s.srv.markDeregistered(ctx, name, id, deregisteredExpiration); err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, err)
+		return
+	}
+	cur, err := s.srv.modifyInstance(ctx, name, id, func(cur *service) (*service, bool, error) {
+		return nil, cur != nil, nil
+	})
+	if err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, err)
+		return
+	}
+	if cur == nil {
+		s.srv.client.Del(ctx, s.srv.keys.deregistered(name, id))
+		writeAdminReply(w, http.StatusNotFound, errors.New("instance not found"))
+		return
+	}
+	if err := s.srv.forget(ctx, name, id, cur); err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, err)
+		return
+	}
+	slog.Info(fmt.Sprintf("admin: deregister name=%s, connector=%s", name, id))
+	writeAdminReply(w, http.StatusOK, nil)
+}
+
+func (s *adminServer) health(w http.ResponseWriter, r *http.Request) {
+	records, err := s.srv.healthOf(r.Context(), r.PathValue("name"))
+	if err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, err)
+		return
+	}
+	util.WriteJSON(w, http.StatusOK, records)
+}
+
+// report counts a failed connection to an instance, or clears its failures on success.
+func (s *adminServer) report(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		writeAdminReply(w, http.StatusForbidden, errors.New("admin token required"))
+		return
+	}
+
+	name, id := r.PathValue("name"), r.PathValue("id")
+
+	var req adminReportRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAdminReply(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	ok, err := s.srv.client.HExists(r.Context(), s.srv.keys.service(name), id).Result()
+	if err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeAdminReply(w, http.StatusNotFound, errors.New("instance not found"))
+		return
+	}
+
+	var failure error
+	if !req.Ok {
+		failure = errors.New(cmp.Or(req.Error, "reported failure"))
+	}
+	if err := s.srv.reportHealth(r.Context(), name, id, failure); err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminReply(w, http.StatusOK, nil)
+}
+
+func (s *adminServer) stats(w http.ResponseWriter, r *http.Request) {
+	util.WriteJSON(w, http.StatusOK, adminStatsReply{
+		Renew: s.srv.renewStats.stats(),
+	})
+}
+
+func writeAdminReply(w http.ResponseWriter, code int, err error) {
+	reply := adminReply{Ok: err == nil}
+	if err != nil {
+		reply.Error = err.Error()
+		if code == http.StatusInternalServerError {
+			slog.Error(fmt.Sprintf("admin: %v", err))
+		}
+	}
+	util.WriteJSON(w, code, reply)
+}
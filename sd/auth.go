@@ -0,0 +1,178 @@
+package sd
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// request metadata carrying a per-service secret
+	metaSecret = "secret"
+)
+
+var (
+	// ErrUnauthenticated is returned when authentication is enabled and the caller presents no valid credentials.
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrNotOwner is returned when the caller does not own the service name or the instance it modifies.
+	ErrNotOwner = errors.New("not the owner")
+)
+
+// authConfig is the JSON layout of the auth file:
+//
+//	{
+//	  "tokens": {"<token>": "node-1"},
+//	  "secrets": {"web": "<secret>"},
+//	  "services": {"api": ["node-1", "node-2"]}
+//	}
+//
+// Tokens map bearer tokens (authorization: Bearer <token>) to caller identities.
+// Secrets are per-service: a caller presenting the secret of a service name
+// (secret: <secret>) may modify that service only. Services lists the identities
+// allowed to register instances of a name, other names are claimed by the first
+// identity registering them.
+type authConfig struct {
+	Tokens   map[string]string   `json:"tokens"`
+	Secrets  map[string]string   `json:"secrets"`
+	Services map[string][]string `json:"services"`
+}
+
+func loadAuthConfig(file string) (*authConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &authConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	for token, id := range cfg.Tokens {
+		if token == "" || id == "" {
+			return nil, errors.New("auth file: empty token or identity")
+		}
+	}
+	return cfg, nil
+}
+
+// serverTLSConfig returns the TLS configuration of the gRPC server. With a client CA,
+// client certificates are verified if given and identify the caller by their common name.
+func serverTLSConfig(opts *Options) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if opts.TLSClientCAFile != "" {
+		data, err := os.ReadFile(opts.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates", opts.TLSClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// authEnabled reports whether Register, Renew and Deregister require an authenticated caller.
+func (s *server) authEnabled() bool {
+	return s.auth != nil || s.opts.TLSClientCAFile != ""
+}
+
+// identify returns the identity of the caller modifying the service name: the common
+// name of its verified client certificate, the identity of its bearer token or,
+// with the secret of the service, "secret:<name>".
+func (s *server) identify(ctx context.Context, name string) (string, error) {
+	if p, _ := peer.FromContext(ctx); p != nil {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			if cn := info.State.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+				return cn, nil
+			}
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if s.auth != nil && md != nil {
+		if v, ok := strings.CutPrefix(mdValue(md, "authorization"), "Bearer "); ok {
+			for token, id := range s.auth.Tokens {
+				if subtle.ConstantTimeCompare([]byte(v), []byte(token)) == 1 {
+					return id, nil
+				}
+			}
+		}
+		if v := mdValue(md, metaSecret); v != "" {
+			if secret, ok := s.auth.Secrets[name]; ok && subtle.ConstantTimeCompare([]byte(v), []byte(secret)) == 1 {
+				return "secret:" + name, nil
+			}
+		}
+	}
+	return "", ErrUnauthenticated
+}
+
+// authorize authenticates the caller and checks that it may modify the service name.
+// The first identity registering a name not listed in the auth file claims it, with
+// claim set. It returns the caller identity, empty if authentication is disabled.
+func (s *server) authorize(ctx context.Context, name string, claim bool) (string, error) {
+	if !s.authEnabled() {
+		return "", nil
+	}
+
+	id, err := s.identify(ctx, name)
+	if err != nil {
+		return "", status.Error(codes.Unauthenticated, err.Error())
+	}
+	if id == "secret:"+name {
+		return id, nil
+	}
+	if s.auth != nil {
+		if ids, ok := s.auth.Services[name]; ok {
+			if !slices.Contains(ids, id) {
+				return "", status.Error(codes.PermissionDenied, fmt.Sprintf("%s: %v", name, ErrNotOwner))
+			}
+			return id, nil
+		}
+	}
+
+	if claim {
+		if err := s.client.HSetNX(ctx, s.keys.owners(), name, id).Err(); err != nil {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+	}
+	owner, err := s.client.HGet(ctx, s.keys.owners(), name).Result()
+	if err != nil && err != redis.Nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if owner != "" && owner != id {
+		return "", status.Error(codes.PermissionDenied, fmt.Sprintf("%s: %v", name, ErrNotOwner))
+	}
+	return id, nil
+}
+
+// checkOwner checks that the caller id may modify the instance sv,
+// which is owned by the identity that registered it.
+func checkOwner(id string, sv *service) error {
+	if id != "" && sv.Owner != "" && sv.Owner != id {
+		return status.Error(codes.PermissionDenied, ErrNotOwner.Error())
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ginuerzh/gost-plugins/internal/util"
+)
+
+// ServiceInfo describes a service in admin listings.
+type ServiceInfo struct {
+	Name string `json:"name"`
+	// stored instances, including those not renewed within Options.RedisExpiration
+	Instances int `json:"instances"`
+	// instances renewed within Options.RedisExpiration
+	Live int `json:"live"`
+}
+
+// InstanceInfo describes an instance in admin listings.
+type InstanceInfo struct {
+	Instance
+	Owner string `json:"owner,omitempty"`
+	// seconds since the last renewal
+	Age int64 `json:"age"`
+	// not renewed within Options.RedisExpiration, to be swept
+	Stale bool `json:"stale,omitempty"`
+	// marked unhealthy by probes or reports
+	Unhealthy bool   `json:"unhealthy,omitempty"`
+	Failures  int    `json:"failures,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// listServices returns a page of the registered service names starting with prefix,
+// starting at cursor. The returned cursor is zero when the listing is complete.
+func (s *server) listServices(ctx context.Context, cursor uint64, count int64, prefix string) ([]ServiceInfo, uint64, error) {
+	names, next, err := s.client.SScan(ctx, s.keys.services(), cursor, util.EscapeGlob(prefix)+"*", count).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	slices.Sort(names)
+
+	services := make([]ServiceInfo, 0, len(names))
+	for _, name := range names {
+		instances, err := s.listInstances(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		info := ServiceInfo{
+			Name:      name,
+			Instances: len(instances),
+		}
+		for i := range instances {
+			if !instances[i].Stale {
+				info.Live++
+			}
+		}
+		services = append(services, info)
+	}
+	return services, next, nil
+}
+
+// listInstances returns all stored instances of the service name, ordered by ID.
+func (s *server) listInstances(ctx context.Context, name string) ([]InstanceInfo, error) {
+	m, err := s.client.HGetAll(ctx, s.keys.service(name)).Result()
+	if err != nil {
+		return nil, err
+	}
+	records, err := s.healthOf(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	instances := make([]InstanceInfo, 0, len(m))
+	for id, v := range m {
+		var sv service
+		if err := json.Unmarshal([]byte(v), &sv); err != nil {
+			continue
+		}
+		age := now.Sub(time.Unix(sv.Renew, 0))
+		info := InstanceInfo{
+			Instance: newInstance(id, &sv),
+			Owner:    sv.Owner,
+			Age:      int64(age.Seconds()),
+			Stale:    age > s.opts.RedisExpiration,
+		}
+		if h := records[id]; h != nil {
+			info.Unhealthy = h.down(now)
+			info.Failures = h.Failures
+			info.Error = h.Error
+		}
+		instances = append(instances, info)
+	}
+	slices.SortFunc(instances, func(a, b InstanceInfo) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return instances, nil
+}
+
+// forget drops the health record and the renew index entry of the removed
+// instance id of the service name and announces its removal. The name is
+// released once its last instance is gone.
+func (s *server) forget(ctx context.Context, name, id string, cur *service) error {
+	if err := s.client.HDel(ctx, s.keys.health(name), id).Err(); err != nil {
+		return err
+	}
+	s.unindexRenew(ctx, name, id)
+	s.publish(ctx, EventRemove, name, Instance{ID: id, Node: cur.Node, Generation: cur.Generation})
+	return s.releaseName(ctx, name)
+}
@@ -0,0 +1,177 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultEventChannel = "gost:pubsub:sd:events"
+
+	// events buffered for a watcher before it is dropped as too slow
+	watcherBuffer = 64
+)
+
+// Actions of instance change events.
+const (
+	EventAdd    = "add"
+	EventUpdate = "update"
+	EventRemove = "remove"
+)
+
+// Instance is a registered instance of a service.
+type Instance struct {
+	ID      string            `json:"id"`
+	Node    string            `json:"node,omitempty"`
+	Network string            `json:"network,omitempty"`
+	Address string            `json:"address,omitempty"`
+	Weight  int               `json:"weight,omitempty"`
+	Zone    string            `json:"zone,omitempty"`
+	Region  string            `json:"region,omitempty"`
+	Version string            `json:"version,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// unix time of the last renewal
+	Renew      int64 `json:"renew,omitempty"`
+	Generation int64 `json:"generation,omitempty"`
+}
+
+func newInstance(id string, sv *service) Instance {
+	return Instance{
+		ID:         id,
+		Node:       sv.Node,
+		Network:    sv.Network,
+		Address:    sv.Address,
+		Weight:     sv.Weight,
+		Zone:       sv.Zone,
+		Region:     sv.Region,
+		Version:    sv.Version,
+		Labels:     sv.Labels,
+		Renew:      sv.Renew,
+		Generation: sv.Generation,
+	}
+}
+
+// Event is published to Options.EventChannel when an instance of a service changes.
+type Event struct {
+	// service name
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// the instance after the change, only its ID for removals
+	Instance Instance  `json:"instance"`
+	Time     time.Time `json:"time"`
+}
+
+// publish sends an instance change event, if events are enabled.
+func (s *server) publish(ctx context.Context, action, name string, inst Instance) {
+	if s.opts.EventChannel == "" {
+		return
+	}
+
+	v, err := json.Marshal(Event{
+		Name:     name,
+		Action:   action,
+		Instance: inst,
+		Time:     time.Now(),
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("event: %v", err))
+		return
+	}
+	if err := s.client.Publish(ctx, s.opts.EventChannel, v).Err(); err != nil {
+		slog.Error(fmt.Sprintf("event %s %s/%s: %v", action, name, inst.ID, err))
+	}
+}
+
+// watchEvents dispatches the events of Options.EventChannel, published by any
+// replica, to the local watchers.
+func (s *server) watchEvents(ctx context.Context) {
+	pubsub := s.client.Subscribe(ctx, s.opts.EventChannel)
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var ev Event
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+				slog.Warn(fmt.Sprintf("event: %v", err))
+				continue
+			}
+			s.watchers.dispatch(&ev)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watcher receives the events of a service. Its channel is closed
+// when it falls more than watcherBuffer events behind.
+type watcher struct {
+	name string
+	ch   chan *Event
+}
+
+// watchers is the set of the local watchers by service name.
+type watchers struct {
+	mu sync.Mutex
+	m  map[string]map[*watcher]struct{}
+}
+
+func (ws *watchers) add(name string) *watcher {
+	w := &watcher{
+		name: name,
+		ch:   make(chan *Event, watcherBuffer),
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.m == nil {
+		ws.m = make(map[string]map[*watcher]struct{})
+	}
+	if ws.m[name] == nil {
+		ws.m[name] = make(map[*watcher]struct{})
+	}
+	ws.m[name][w] = struct{}{}
+	return w
+}
+
+func (ws *watchers) remove(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if _, ok := ws.m[w.name][w]; !ok {
+		// dropped by dispatch
+		return
+	}
+	delete(ws.m[w.name], w)
+	if len(ws.m[w.name]) == 0 {
+		delete(ws.m, w.name)
+	}
+	close(w.ch)
+}
+
+func (ws *watchers) dispatch(ev *Event) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for w := range ws.m[ev.Name] {
+		select {
+		case w.ch <- ev:
+		default:
+			slog.Warn(fmt.Sprintf("watch %s: watcher too slow, dropped", ev.Name))
+			delete(ws.m[ev.Name], w)
+			close(w.ch)
+		}
+	}
+	if len(ws.m[ev.Name]) == 0 {
+		delete(ws.m, ev.Name)
+	}
+}
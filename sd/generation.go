@@ -0,0 +1,159 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	sd_proto "github.com/go-gost/plugin/sd/proto"
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Policies for a registration conflicting with a live instance of another connector.
+const (
+	// ConflictReplace replaces the instance, the renewals of the former connector are rejected.
+	ConflictReplace = "replace"
+	// ConflictReject rejects the registration until the instance expires or is deregistered.
+	ConflictReject = "reject"
+)
+
+const (
+	// request and response metadata carrying the generation of an instance
+	metaGeneration = "generation"
+)
+
+var (
+	// ErrInvalidConflict is returned for an unknown conflict policy.
+	ErrInvalidConflict = errors.New("invalid conflict policy")
+	// ErrConflict is returned when the instance ID is registered by another connector.
+	ErrConflict = errors.New("instance registered by another connector")
+	// ErrStaleGeneration is returned to a connector whose instance was replaced.
+	ErrStaleGeneration = errors.New("stale generation")
+)
+
+func validConflict(policy string) bool {
+	switch policy {
+	case "", ConflictReplace, ConflictReject:
+		return true
+	default:
+		return false
+	}
+}
+
+// peerHost returns the host of the peer address of the caller.
+func peerHost(ctx context.Context) string {
+	p, _ := peer.FromContext(ctx)
+	if p == nil || p.Addr == nil {
+		return ""
+	}
+	host := p.Addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// conflicts reports whether the live instance cur was registered by another
+// connector than next, a different node or peer address.
+func (s *server) conflicts(cur, next *service) bool {
+	if time.Since(time.Unix(cur.Renew, 0)) > s.opts.RedisExpiration {
+		return false
+	}
+	return cur.Node != next.Node || (cur.Peer != "" && next.Peer != "" && cur.Peer != next.Peer)
+}
+
+// checkGeneration checks that a renewal or deregistration of the caller applies to the
+// current registration cur: the generation request metadata must match it, callers
+// without generation must be on the node of cur.
+func checkGeneration(ctx context.Context, srv *sd_proto.Service, cur *service) error {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := mdValue(md, metaGeneration); v != "" {
+			gen, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return status.Error(codes.InvalidArgument, fmt.Sprintf("invalid generation: %s", v))
+			}
+			if gen != cur.Generation {
+				return status.Error(codes.FailedPrecondition, ErrStaleGeneration.Error())
+			}
+			return nil
+		}
+	}
+	if srv.Node != "" && cur.Node != "" && srv.Node != cur.Node {
+		return status.Error(codes.FailedPrecondition, ErrStaleGeneration.Error())
+	}
+	return nil
+}
+
+// sendGeneration returns the generation of the instance in the response header.
+func sendGeneration(ctx context.Context, gen int64) {
+	if err := grpc.SetHeader(ctx, metadata.Pairs(metaGeneration, strconv.FormatInt(gen, 10))); err != nil {
+		slog.Debug(fmt.Sprintf("generation header: %v", err))
+	}
+}
+
+// nextGeneration returns a new generation, increasing across all instances so that
+// an instance deleted and registered again never reuses one.
+func (s *server) nextGeneration(ctx context.Context) (int64, error) {
+	return s.client.Incr(ctx, s.keys.generation()).Result()
+}
+
+// modifyInstance atomically applies fn to the instance id of the service name.
+// fn is called with the current instance, nil if there is none, and returns the
+// instance to store, nil to leave it unchanged, or remove set to delete it.
+// The instance before the change is returned.
+func (s *server) modifyInstance(ctx context.Context, name, id string, fn func(cur *service) (next *service, remove bool, err error)) (cur *service, err error) {
+	key := s.keys.service(name)
+	for i := 0; i < updateAttempts; i++ {
+		err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+			cur = nil
+			v, err := tx.HGet(ctx, key, id).Bytes()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if err == nil {
+				cur = &service{}
+				if json.Unmarshal(v, cur) != nil {
+					cur = nil
+				}
+			}
+
+			next, remove, err := fn(cur)
+			if err != nil {
+				return err
+			}
+			if next == nil && !remove {
+				return nil
+			}
+			if next != nil {
+				if v, err = json.Marshal(next); err != nil {
+					return err
+				}
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if remove {
+					pipe.HDel(ctx, key, id)
+					return nil
+				}
+				pipe.HSet(ctx, key, id, v)
+				pipe.Expire(ctx, key, s.opts.RedisExpiration)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	return cur, err
+}
@@ -0,0 +1,239 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultHealthFailures = 3
+	defaultHealthCooldown = 30 * time.Second
+	defaultProbeTimeout   = 3 * time.Second
+
+	// instances probed concurrently
+	probeConcurrency = 16
+	// attempts of an optimistic health update before giving up
+	updateAttempts = 3
+)
+
+// health is the health record of a service instance. Healthy instances have no record.
+type health struct {
+	// consecutive failed probes and failure reports
+	Failures int `json:"failures"`
+	// unix time until which the instance is considered unhealthy, zero if it is not
+	Down int64 `json:"down,omitempty"`
+	// reason of the last failure
+	Error string `json:"error,omitempty"`
+	// unix time of the last failure
+	Updated int64 `json:"updated"`
+}
+
+// down reports whether the instance of the record h is unhealthy at now.
+func (h *health) down(now time.Time) bool {
+	return h != nil && h.Down > now.Unix()
+}
+
+func (s *server) healthFailures() int {
+	if s.opts.HealthFailures > 0 {
+		return s.opts.HealthFailures
+	}
+	return defaultHealthFailures
+}
+
+func (s *server) healthCooldown() time.Duration {
+	if s.opts.HealthCooldown > 0 {
+		return s.opts.HealthCooldown
+	}
+	return defaultHealthCooldown
+}
+
+// failureWindow is how long failures are counted towards Options.HealthFailures:
+// long enough for that many probes with active probing, Options.HealthCooldown otherwise.
+func (s *server) failureWindow() time.Duration {
+	if s.opts.ProbeInterval > 0 {
+		return s.opts.ProbeInterval * time.Duration(s.healthFailures())
+	}
+	return s.healthCooldown()
+}
+
+// reportHealth records the outcome of a probe or a connection to the instance id
+// of the service name: a nil failure clears its record, failures are counted and mark
+// the instance unhealthy for Options.HealthCooldown once Options.HealthFailures is reached.
+// Failures older than the failure window are forgotten.
+func (s *server) reportHealth(ctx context.Context, name, id string, failure error) (err error) {
+	hk := s.keys.health(name)
+	if failure == nil {
+		return s.client.HDel(ctx, hk, id).Err()
+	}
+
+	cooldown := s.healthCooldown()
+	window := s.failureWindow()
+	var h health
+	for i := 0; i < updateAttempts; i++ {
+		err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+			h = health{}
+			v, err := tx.HGet(ctx, hk, id).Bytes()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if err == nil {
+				json.Unmarshal(v, &h)
+			}
+
+			now := time.Now()
+			if now.Sub(time.Unix(h.Updated, 0)) > window && !h.down(now) {
+				h = health{}
+			}
+			h.Failures++
+			h.Error = failure.Error()
+			h.Updated = now.Unix()
+			if h.Failures >= s.healthFailures() {
+				h.Down = now.Add(cooldown).Unix()
+			}
+			if v, err = json.Marshal(h); err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, hk, id, v)
+				pipe.Expire(ctx, hk, max(window, cooldown))
+				return nil
+			})
+			return err
+		}, hk)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err == nil && h.Failures == s.healthFailures() {
+		slog.Warn(fmt.Sprintf("unhealthy name=%s, connector=%s: %s", name, id, h.Error))
+	}
+	return err
+}
+
+// healthOf returns the health records of the instances of the service name.
+func (s *server) healthOf(ctx context.Context, name string) (map[string]*health, error) {
+	m, err := s.client.HGetAll(ctx, s.keys.health(name)).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]*health, len(m))
+	for id, v := range m {
+		h := &health{}
+		if err := json.Unmarshal([]byte(v), h); err != nil {
+			continue
+		}
+		records[id] = h
+	}
+	return records, nil
+}
+
+// runProber probes the addresses of all registered instances every Options.ProbeInterval.
+func (s *server) runProber(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.probeAll(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *server) probeAll(ctx context.Context) {
+	// with several replicas, only one of them probes per interval.
+	ok, err := s.client.SetNX(ctx, s.keys.probe(), 1, s.opts.ProbeInterval/2).Result()
+	if err != nil || !ok {
+		if err != nil {
+			slog.Error(fmt.Sprintf("probe: %v", err))
+		}
+		return
+	}
+
+	names, err := s.client.SMembers(ctx, s.keys.services()).Result()
+	if err != nil {
+		slog.Error(fmt.Sprintf("probe: %v", err))
+		return
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, probeConcurrency)
+	for _, name := range names {
+		m, err := s.client.HGetAll(ctx, s.keys.service(name)).Result()
+		if err != nil {
+			slog.Error(fmt.Sprintf("probe %s: %v", name, err))
+			continue
+		}
+		if len(m) == 0 {
+			// all instances expired or deregistered.
+			s.client.SRem(ctx, s.keys.services(), name)
+			continue
+		}
+
+		for id, v := range m {
+			var sv service
+			if err := json.Unmarshal([]byte(v), &sv); err != nil || sv.Address == "" {
+				continue
+			}
+			if time.Since(time.Unix(sv.Renew, 0)) > s.opts.RedisExpiration {
+				continue
+			}
+
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				err := s.probe(ctx, sv.Network, sv.Address)
+				if err := s.reportHealth(ctx, name, id, err); err != nil {
+					slog.Error(fmt.Sprintf("probe %s/%s: %v", name, id, err))
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// probe checks that the instance address accepts connections. UDP instances are
+// sent an empty datagram and only fail if it is actively refused.
+func (s *server) probe(ctx context.Context, network, address string) error {
+	timeout := s.opts.ProbeTimeout
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if network != "udp" {
+		return nil
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(nil); err != nil {
+		return err
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package sd
+
+const (
+	// root of the internal keys when no namespace is configured
+	legacyKeyRoot = "gost:sd"
+)
+
+// keyspace maps service names and the plugin's internal records to Redis keys.
+//
+// Without a namespace the layout of older versions is kept: services are stored
+// under their bare name and internal records under "gost:sd:".
+// With namespace N, services are stored under "N:service:<name>" and internal records under "N:".
+type keyspace struct {
+	namespace string
+}
+
+func (ks keyspace) root() string {
+	if ks.namespace == "" {
+		return legacyKeyRoot
+	}
+	return ks.namespace
+}
+
+// service returns the Redis key of the hash holding the instances of the service name.
+func (ks keyspace) service(name string) string {
+	if ks.namespace == "" {
+		return name
+	}
+	return ks.namespace + ":service:" + name
+}
+
+// services is the set of registered service names.
+func (ks keyspace) services() string {
+	return ks.root() + ":services"
+}
+
+// owners is the hash of the identities owning the service names.
+func (ks keyspace) owners() string {
+	return ks.root() + ":owners"
+}
+
+// generation is the counter of the generations of the registered instances.
+func (ks keyspace) generation() string {
+	return ks.root() + ":generation"
+}
+
+// renew is the sorted set of the instance IDs of the service name scored by the unix time they were last renewed.
+func (ks keyspace) renew(name string) string {
+	return ks.root() + ":renew:" + name
+}
+
+// health is the hash of the health records of the instances of the service name.
+func (ks keyspace) health(name string) string {
+	return ks.root() + ":health:" + name
+}
+
+// deregistered marks the instance id of the service name as force deregistered.
+func (ks keyspace) deregistered(name, id string) string {
+	return ks.root() + ":deregistered:" + name + "/" + id
+}
+
+// probe is held by the replica probing the instances during a probe interval.
+func (ks keyspace) probe() string {
+	return ks.root() + ":probe"
+}
+
+// sweep is held by the replica sweeping stale instances during a sweep interval.
+func (ks keyspace) sweep() string {
+	return ks.root() + ":sweep"
+}
@@ -0,0 +1,234 @@
+package sd
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+
+	sd_proto "github.com/go-gost/plugin/sd/proto"
+	"google.golang.org/grpc/metadata"
+)
+
+// Request metadata describing a registered instance and selecting instances in Get.
+const (
+	metaWeight   = "weight"
+	metaZone     = "zone"
+	metaRegion   = "region"
+	metaVersion  = "version"
+	metaLabel    = "label"
+	metaSelector = "selector"
+)
+
+var (
+	errInvalidWeight   = errors.New("invalid weight")
+	errInvalidLabel    = errors.New("invalid label")
+	errInvalidSelector = errors.New("invalid selector")
+)
+
+// instanceMeta parses the metadata of the instance from the Register request metadata:
+//
+//	weight:  relative weight of the instance in Get, 1 by default
+//	zone, region, version
+//	label:   key=value, repeated for each label
+func instanceMeta(ctx context.Context, sv *service) error {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	if v := mdValue(md, metaWeight); v != "" {
+		w, err := strconv.Atoi(v)
+		if err != nil || w < 0 {
+			return fmt.Errorf("%w: %s", errInvalidWeight, v)
+		}
+		sv.Weight = w
+	}
+	sv.Zone = mdValue(md, metaZone)
+	sv.Region = mdValue(md, metaRegion)
+	sv.Version = mdValue(md, metaVersion)
+
+	for _, v := range md.Get(metaLabel) {
+		for _, kv := range strings.Split(v, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+			if k == "" {
+				return fmt.Errorf("%w: %s", errInvalidLabel, kv)
+			}
+			if sv.Labels == nil {
+				sv.Labels = make(map[string]string)
+			}
+			sv.Labels[k] = v
+		}
+	}
+	return nil
+}
+
+func mdValue(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return strings.TrimSpace(v[0])
+	}
+	return ""
+}
+
+// label returns the value of the label key of the instance.
+// Zone, region and version are matched as the labels of the same name.
+func (sv *service) label(key string) (string, bool) {
+	switch key {
+	case metaZone:
+		return sv.Zone, sv.Zone != ""
+	case metaRegion:
+		return sv.Region, sv.Region != ""
+	case metaVersion:
+		return sv.Version, sv.Version != ""
+	}
+	v, ok := sv.Labels[key]
+	return v, ok
+}
+
+func (sv *service) weight() int {
+	if sv.Weight <= 0 {
+		return 1
+	}
+	return sv.Weight
+}
+
+// requirement is a single term of a label selector.
+type requirement struct {
+	key    string
+	values []string
+	// the key must be absent or, with values, have none of them
+	not bool
+}
+
+// selector is a comma separated list of requirements which must all hold:
+//
+//	key=value, key!=value   the label is (not) value
+//	key in (a|b)            the label is one of a or b
+//	key notin (a|b)         the label is none of a or b
+//	key, !key               the label is set (unset)
+type selector []requirement
+
+// parseSelector parses the selector of the Get request metadata, nil if there is none.
+func parseSelector(ctx context.Context) (selector, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+
+	var sel selector
+	for _, v := range md.Get(metaSelector) {
+		for _, term := range strings.Split(v, ",") {
+			term = strings.TrimSpace(term)
+			if term == "" {
+				continue
+			}
+			r, err := parseRequirement(term)
+			if err != nil {
+				return nil, err
+			}
+			sel = append(sel, r)
+		}
+	}
+	return sel, nil
+}
+
+func parseRequirement(term string) (requirement, error) {
+	if k, v, ok := strings.Cut(term, "!="); ok {
+		return newRequirement(k, []string{v}, true, term)
+	}
+	if k, v, ok := strings.Cut(term, "="); ok {
+		return newRequirement(k, []string{v}, false, term)
+	}
+	if k, v, ok := strings.Cut(term, " notin "); ok {
+		values, err := parseSet(v, term)
+		if err != nil {
+			return requirement{}, err
+		}
+		return newRequirement(k, values, true, term)
+	}
+	if k, v, ok := strings.Cut(term, " in "); ok {
+		values, err := parseSet(v, term)
+		if err != nil {
+			return requirement{}, err
+		}
+		return newRequirement(k, values, false, term)
+	}
+	if k, ok := strings.CutPrefix(term, "!"); ok {
+		return newRequirement(k, nil, true, term)
+	}
+	return newRequirement(term, nil, false, term)
+}
+
+func newRequirement(key string, values []string, not bool, term string) (requirement, error) {
+	key = strings.TrimSpace(key)
+	if key == "" || strings.ContainsAny(key, " =!()|") {
+		return requirement{}, fmt.Errorf("%w: %s", errInvalidSelector, term)
+	}
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return requirement{key: key, values: values, not: not}, nil
+}
+
+func parseSet(s, term string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") || !strings.HasSuffix(s, ")") {
+		return nil, fmt.Errorf("%w: %s", errInvalidSelector, term)
+	}
+	return strings.Split(s[1:len(s)-1], "|"), nil
+}
+
+// matches reports whether the instance sv satisfies all requirements of sel.
+func (sel selector) matches(sv *service) bool {
+	for _, r := range sel {
+		v, ok := sv.label(r.key)
+		if r.values == nil {
+			if ok == r.not {
+				return false
+			}
+			continue
+		}
+		if (ok && slices.Contains(r.values, v)) == r.not {
+			return false
+		}
+	}
+	return true
+}
+
+// weighted is a Get result with the weight and the locality tier of its instance.
+type weighted struct {
+	svc    *sd_proto.Service
+	weight int
+	tier   int
+}
+
+// weightedShuffle orders the services by locality tier and, within a tier, by weighted
+// random sampling without replacement: instances of higher weight are more likely to come first.
+func weightedShuffle(ws []weighted) []*sd_proto.Service {
+	keys := make([]float64, len(ws))
+	for i := range ws {
+		// Efraimidis-Spirakis: ascending -ln(u)/w is descending u^(1/w).
+		keys[i] = -math.Log(1-rand.Float64()) / float64(ws[i].weight)
+	}
+	idx := make([]int, len(ws))
+	for i := range idx {
+		idx[i] = i
+	}
+	slices.SortFunc(idx, func(a, b int) int {
+		return cmp.Or(
+			cmp.Compare(ws[a].tier, ws[b].tier),
+			cmp.Compare(keys[a], keys[b]),
+		)
+	})
+
+	services := make([]*sd_proto.Service, len(ws))
+	for i, j := range idx {
+		services[i] = ws[j].svc
+	}
+	return services
+}
@@ -0,0 +1,132 @@
+package sd
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	sd_proto "github.com/go-gost/plugin/sd/proto"
+)
+
+func TestParseRequirement(t *testing.T) {
+	tests := []struct {
+		term string
+		want requirement
+		err  bool
+	}{
+		{"zone=eu-1", requirement{key: "zone", values: []string{"eu-1"}}, false},
+		{" zone = eu-1 ", requirement{key: "zone", values: []string{"eu-1"}}, false},
+		{"version!=1.2", requirement{key: "version", values: []string{"1.2"}, not: true}, false},
+		{"env=", requirement{key: "env", values: []string{""}}, false},
+		{"env in (prod|staging)", requirement{key: "env", values: []string{"prod", "staging"}}, false},
+		{"env in ( prod | staging )", requirement{key: "env", values: []string{"prod", "staging"}}, false},
+		{"env notin (dev)", requirement{key: "env", values: []string{"dev"}, not: true}, false},
+		{"gpu", requirement{key: "gpu"}, false},
+		{"!canary", requirement{key: "canary", not: true}, false},
+		{"=v", requirement{}, true},
+		{"!=v", requirement{}, true},
+		{"env in prod", requirement{}, true},
+		{"env in (prod", requirement{}, true},
+		{"env notin prod)", requirement{}, true},
+		{"a b", requirement{}, true},
+		{"!", requirement{}, true},
+		{"(env)", requirement{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRequirement(tt.term)
+		if tt.err {
+			if !errors.Is(err, errInvalidSelector) {
+				t.Errorf("parseRequirement(%q) = %+v, %v, want errInvalidSelector", tt.term, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRequirement(%q) = %+v, %v, want %+v", tt.term, got, err, tt.want)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	sv := &service{
+		Zone:    "eu-1",
+		Version: "1.2",
+		Labels:  map[string]string{"env": "prod", "gpu": ""},
+	}
+
+	tests := []struct {
+		terms []string
+		want  bool
+	}{
+		{nil, true},
+		{[]string{"zone=eu-1"}, true},
+		{[]string{"zone=eu-2"}, false},
+		{[]string{"zone!=eu-2"}, true},
+		{[]string{"region=eu"}, false},
+		{[]string{"region!=eu"}, true},
+		{[]string{"version in (1.1|1.2)"}, true},
+		{[]string{"version notin (1.1|1.2)"}, false},
+		{[]string{"env notin (dev)"}, true},
+		{[]string{"team notin (a)"}, true},
+		{[]string{"team in (a)"}, false},
+		{[]string{"gpu"}, true},
+		{[]string{"gpu="}, true},
+		{[]string{"!gpu"}, false},
+		{[]string{"region"}, false},
+		{[]string{"!region"}, true},
+		{[]string{"zone=eu-1", "env=prod", "!canary"}, true},
+		{[]string{"zone=eu-1", "env=dev"}, false},
+	}
+	for _, tt := range tests {
+		var sel selector
+		for _, term := range tt.terms {
+			r, err := parseRequirement(term)
+			if err != nil {
+				t.Fatalf("parseRequirement(%q): %v", term, err)
+			}
+			sel = append(sel, r)
+		}
+		if got := sel.matches(sv); got != tt.want {
+			t.Errorf("%q matches = %v, want %v", tt.terms, got, tt.want)
+		}
+	}
+}
+
+func TestWeightedShuffle(t *testing.T) {
+	t.Run("tiers", func(t *testing.T) {
+		ws := []weighted{
+			{svc: &sd_proto.Service{Id: "c"}, weight: 100, tier: 2},
+			{svc: &sd_proto.Service{Id: "a"}, weight: 1, tier: 0},
+			{svc: &sd_proto.Service{Id: "b"}, weight: 100, tier: 1},
+		}
+		for i := 0; i < 100; i++ {
+			services := weightedShuffle(ws)
+			if len(services) != 3 || services[0].Id != "a" || services[1].Id != "b" || services[2].Id != "c" {
+				t.Fatalf("weightedShuffle: got %v, want tier order a, b, c", services)
+			}
+		}
+	})
+
+	t.Run("weights", func(t *testing.T) {
+		ws := []weighted{
+			{svc: &sd_proto.Service{Id: "heavy"}, weight: 9},
+			{svc: &sd_proto.Service{Id: "light"}, weight: 1},
+		}
+		const runs = 10000
+		first := 0
+		for i := 0; i < runs; i++ {
+			if weightedShuffle(ws)[0].Id == "heavy" {
+				first++
+			}
+		}
+		// the heavy instance comes first with probability 9/10.
+		if p := float64(first) / runs; p < 0.85 || p > 0.95 {
+			t.Errorf("weightedShuffle: heavy instance first in %.3f of runs, want about 0.9", p)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		if services := weightedShuffle(nil); len(services) != 0 {
+			t.Errorf("weightedShuffle(nil) = %v, want empty", services)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/ginuerzh/gost-plugins/internal/util"
+	"github.com/go-redis/redis/v8"
+)
+
+// Migrate moves the service hashes and internal records stored in the unprefixed
+// layout of older versions into Options.Namespace. With dryRun set, the keys to move are only
+// logged. Keys already present in the namespace are left untouched.
+func Migrate(ctx context.Context, opts *Options, dryRun bool) error {
+	if opts == nil || opts.Namespace == "" {
+		return errors.New("migrate: namespace is required")
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     opts.RedisAddr,
+		DB:       opts.RedisDB,
+		Username: opts.RedisUsername,
+		Password: opts.RedisPassword,
+	})
+	defer client.Close()
+
+	keys := keyspace{namespace: opts.Namespace}
+	return util.MigrateKeys(ctx, client, opts.Namespace, legacyKeyRoot, func(ctx context.Context, key string) (string, error) {
+		ok, err := migratableService(ctx, client, key)
+		if err != nil || !ok {
+			return "", err
+		}
+		return keys.service(key), nil
+	}, dryRun)
+}
+
+// migratableService reports whether the unprefixed key holds a service hash,
+// that is a hash whose fields are all service instances.
+func migratableService(ctx context.Context, client *redis.Client, key string) (bool, error) {
+	typ, err := client.Type(ctx, key).Result()
+	if err != nil || typ != "hash" {
+		return false, err
+	}
+	m, err := client.HGetAll(ctx, key).Result()
+	if err != nil || len(m) == 0 {
+		return false, err
+	}
+	for _, v := range m {
+		var srv service
+		if err := json.Unmarshal([]byte(v), &srv); err != nil || srv.Node == "" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,117 @@
+package sd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	sd_proto "github.com/go-gost/plugin/sd/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Policies for renewing an instance that is not registered, e.g. after its
+// record was lost in a Redis restart or eviction.
+const (
+	// RenewMissingReply replies with Ok unset, as older versions did.
+	RenewMissingReply = "reply"
+	// RenewMissingNotFound fails with codes.NotFound, telling the connector to register again.
+	RenewMissingNotFound = "notfound"
+	// RenewMissingRecreate registers the instance again from the renew request
+	// if it carries the node and address, otherwise fails like RenewMissingNotFound.
+	RenewMissingRecreate = "recreate"
+)
+
+const (
+	// how long a force deregistered instance is not recreated by its renewals
+	deregisteredExpiration = 24 * time.Hour
+	// how long a deregistered instance is not recreated by late renewals,
+	// without Options.RedisExpiration
+	deregisteredGrace = time.Minute
+)
+
+var (
+	// ErrInvalidRenewMissing is returned for an unknown policy for renewing missing instances.
+	ErrInvalidRenewMissing = errors.New("invalid renew missing policy")
+	// ErrNotRegistered is returned when renewing an instance that is not registered.
+	ErrNotRegistered = errors.New("instance not registered, register again")
+)
+
+func validRenewMissing(policy string) bool {
+	switch policy {
+	case "", RenewMissingReply, RenewMissingNotFound, RenewMissingRecreate:
+		return true
+	default:
+		return false
+	}
+}
+
+// RenewStats are the counters of renewals of instances that were not registered.
+type RenewStats struct {
+	Missing uint64 `json:"missing"`
+	// missing instances registered again from the renew request
+	Recreated uint64 `json:"recreated"`
+	// missing instances that could not be registered again
+	Failed uint64 `json:"failed"`
+}
+
+type renewStats struct {
+	missing   atomic.Uint64
+	recreated atomic.Uint64
+	failed    atomic.Uint64
+}
+
+func (rs *renewStats) stats() *RenewStats {
+	return &RenewStats{
+		Missing:   rs.missing.Load(),
+		Recreated: rs.recreated.Load(),
+		Failed:    rs.failed.Load(),
+	}
+}
+
+// renewMissing handles the renewal of the instance srv which is not registered,
+// according to Options.RenewMissing.
+func (s *server) renewMissing(ctx context.Context, srv *sd_proto.Service) (*sd_proto.RenewReply, error) {
+	s.renewStats.missing.Add(1)
+
+	switch s.opts.RenewMissing {
+	case RenewMissingNotFound:
+		return nil, status.Error(codes.NotFound, ErrNotRegistered.Error())
+	case RenewMissingRecreate:
+	default:
+		return &sd_proto.RenewReply{}, nil
+	}
+
+	if srv.Node == "" || srv.Address == "" {
+		s.renewStats.failed.Add(1)
+		return nil, status.Error(codes.NotFound, ErrNotRegistered.Error())
+	}
+	n, err := s.client.Exists(ctx, s.keys.deregistered(srv.Name, srv.Id)).Result()
+	if err != nil {
+		s.renewStats.failed.Add(1)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if n > 0 {
+		s.renewStats.failed.Add(1)
+		slog.Info(fmt.Sprintf("renew name=%s, connector=%s: deregistered, not recreated", srv.Name, srv.Id))
+		return nil, status.Error(codes.NotFound, ErrNotRegistered.Error())
+	}
+	if _, err := s.Register(ctx, &sd_proto.RegisterRequest{Service: srv}); err != nil {
+		s.renewStats.failed.Add(1)
+		slog.Warn(fmt.Sprintf("renew name=%s, connector=%s: recreate: %v", srv.Name, srv.Id, err))
+		return nil, err
+	}
+	s.renewStats.recreated.Add(1)
+	slog.Info(fmt.Sprintf("renew name=%s, connector=%s: recreated", srv.Name, srv.Id))
+
+	return &sd_proto.RenewReply{Ok: true}, nil
+}
+
+// markDeregistered records that the instance id of the service name was deregistered,
+// so that its renewals do not recreate it for expiration or until it registers again.
+func (s *server) markDeregistered(ctx context.Context, name, id string, expiration time.Duration) error {
+	return s.client.Set(ctx, s.keys.deregistered(name, id), time.Now().Unix(), expiration).Err()
+}
@@ -3,9 +3,9 @@ package sd
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"math/rand"
 	"net"
 	"time"
 
@@ -13,7 +13,7 @@ import (
 	"github.com/go-redis/redis/v8"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 )
 
@@ -25,6 +25,18 @@ type service struct {
 	Address string
 	// 最后更新时间
 	Renew int64
+	// relative weight in Get, 1 if zero
+	Weight  int               `json:",omitempty"`
+	Zone    string            `json:",omitempty"`
+	Region  string            `json:",omitempty"`
+	Version string            `json:",omitempty"`
+	Labels  map[string]string `json:",omitempty"`
+	// identity of the caller that registered the instance, empty without authentication
+	Owner string `json:",omitempty"`
+	// host of the peer address of the connector
+	Peer string `json:",omitempty"`
+	// increased on every registration, see checkGeneration
+	Generation int64 `json:",omitempty"`
 }
 
 // Options configures the SD server's Redis backend.
@@ -34,12 +46,61 @@ type Options struct {
 	RedisUsername   string
 	RedisPassword   string
 	RedisExpiration time.Duration
+	// Namespace prefixes the Redis keys of the plugin, see keyspace.
+	// Empty keeps the unprefixed layout of older versions.
+	Namespace string
+	// SweepInterval is how often instances not renewed within RedisExpiration
+	// are deleted, zero disables the sweeper.
+	SweepInterval time.Duration
+	// EventChannel is the Redis pub/sub channel of instance change events,
+	// empty to disable them and the watch API.
+	EventChannel string
+	// ZoneFile is the JSON file mapping CIDR networks to zones and regions, see zoneMap.
+	// Get orders instances in the zone of the caller first, then those in its region.
+	ZoneFile string
+	// AuthFile is the JSON file of the tokens, per-service secrets and service owners
+	// of Register, Renew and Deregister callers, see authConfig.
+	AuthFile string
+	// TLSCertFile and TLSKeyFile enable TLS on the gRPC server.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile verifies client certificates, which identify callers by their common name.
+	// Setting it or AuthFile requires callers to authenticate.
+	TLSClientCAFile string
+	// Conflict is the policy for registering an instance ID of a live instance of another
+	// node or peer address: ConflictReplace (default) or ConflictReject.
+	Conflict string
+	// RenewMissing is the policy for renewing an instance that is not registered:
+	// RenewMissingReply (default), RenewMissingNotFound or RenewMissingRecreate.
+	RenewMissing string
+	// ProbeInterval is how often the addresses of the instances are probed, zero disables probing.
+	ProbeInterval time.Duration
+	// ProbeTimeout bounds a single probe, 3s by default.
+	ProbeTimeout time.Duration
+	// HealthFailures is the number of consecutive failed probes or reports
+	// after which an instance is unhealthy, 3 by default.
+	HealthFailures int
+	// HealthCooldown is how long an instance stays unhealthy, 30s by default.
+	HealthCooldown time.Duration
+	// HealthExclude drops unhealthy instances from Get unless none is healthy,
+	// otherwise they are returned after the healthy ones.
+	HealthExclude bool
+	// AdminAddr is the listen address of the admin HTTP API, empty to disable it.
+	AdminAddr string
+	// AdminToken, if set, is required by the admin HTTP API as a bearer token.
+	AdminToken string
 }
 
 type server struct {
 	client *redis.Client
 	sd_proto.UnimplementedSDServer
-	opts *Options
+	keys     keyspace
+	opts     *Options
+	zones    zoneMap
+	auth     *authConfig
+	watchers watchers
+
+	renewStats renewStats
 }
 
 // ListenAndServe starts the SD gRPC server on addr using the given Redis-backed options.
@@ -48,6 +109,40 @@ func ListenAndServe(addr string, opts *Options) error {
 		opts = &Options{}
 	}
 
+	if !validConflict(opts.Conflict) {
+		return fmt.Errorf("%w: %s", ErrInvalidConflict, opts.Conflict)
+	}
+	if !validRenewMissing(opts.RenewMissing) {
+		return fmt.Errorf("%w: %s", ErrInvalidRenewMissing, opts.RenewMissing)
+	}
+
+	var zones zoneMap
+	if opts.ZoneFile != "" {
+		var err error
+		if zones, err = loadZoneMap(opts.ZoneFile); err != nil {
+			return err
+		}
+	}
+
+	var auth *authConfig
+	if opts.AuthFile != "" {
+		var err error
+		if auth, err = loadAuthConfig(opts.AuthFile); err != nil {
+			return err
+		}
+	}
+
+	var serverOpts []grpc.ServerOption
+	if opts.TLSCertFile != "" {
+		cfg, err := serverTLSConfig(opts)
+		if err != nil {
+			return err
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(cfg)))
+	} else if opts.TLSClientCAFile != "" {
+		return errors.New("client CA requires a TLS certificate")
+	}
+
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
@@ -61,13 +156,37 @@ func ListenAndServe(addr string, opts *Options) error {
 		Password: opts.RedisPassword,
 	})
 
-	s := grpc.NewServer()
+	s := grpc.NewServer(serverOpts...)
 	srv := &server{
 		client: rdb,
+		keys:   keyspace{namespace: opts.Namespace},
 		opts:   opts,
+		zones:  zones,
+		auth:   auth,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if opts.SweepInterval > 0 {
+		go srv.runSweeper(ctx)
+	}
+	if opts.EventChannel != "" {
+		go srv.watchEvents(ctx)
+	}
+	if opts.ProbeInterval > 0 {
+		go srv.runProber(ctx)
+	}
+	if opts.AdminAddr != "" {
+		go func() {
+			if err := listenAndServeAdmin(opts.AdminAddr, srv); err != nil {
+				slog.Error(fmt.Sprintf("admin: %v", err))
+			}
+		}()
 	}
 
 	sd_proto.RegisterSDServer(s, srv)
+	s.RegisterService(&watchServiceDesc, srv)
 	return s.Serve(ln)
 }
 
@@ -81,8 +200,10 @@ func (s *server) Register(ctx context.Context, in *sd_proto.RegisterRequest) (*s
 
 	log := slog.With("op", "register", "name", srv.Name, "connector", srv.Id, "node", srv.Node, "network", srv.Network, "address", srv.Address)
 
-	var addr net.Addr
-	var err error
+	var (
+		addr net.Addr
+		err  error
+	)
 	switch srv.Network {
 	case "udp":
 		addr, err = net.ResolveUDPAddr("udp", srv.Address)
@@ -94,15 +215,10 @@ func (s *server) Register(ctx context.Context, in *sd_proto.RegisterRequest) (*s
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	peerAddr := peerHost(ctx)
 	address := srv.Address
-	if host, port, _ := net.SplitHostPort(address); host == "" {
-		if peer, _ := peer.FromContext(ctx); peer != nil && peer.Addr != nil {
-			host := peer.Addr.String()
-			if h, _, _ := net.SplitHostPort(host); h != "" {
-				host = h
-			}
-			address = net.JoinHostPort(host, port)
-		}
+	if host, port, _ := net.SplitHostPort(address); host == "" && peerAddr != "" {
+		address = net.JoinHostPort(peerAddr, port)
 	}
 
 	sv := service{
@@ -110,23 +226,68 @@ func (s *server) Register(ctx context.Context, in *sd_proto.RegisterRequest) (*s
 		Network: addr.Network(),
 		Address: address,
 		Renew:   time.Now().Unix(),
+		Peer:    peerAddr,
 	}
-	v, err := json.Marshal(sv)
-	if err != nil {
+	if err := instanceMeta(ctx, &sv); err != nil {
 		log.Error(err.Error())
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	if _, err := s.client.HSet(ctx, srv.Name, srv.Id, v).Result(); err != nil {
-		log.Error(err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+	// the name is only claimed by valid registrations.
+	owner, err := s.authorize(ctx, srv.Name, true)
+	if err != nil {
+		log.Warn(err.Error())
+		return nil, err
+	}
+	sv.Owner = owner
+
+	replaced := false
+	cur, err := s.modifyInstance(ctx, srv.Name, srv.Id, func(cur *service) (*service, bool, error) {
+		replaced = false
+		if cur != nil {
+			if err := checkOwner(owner, cur); err != nil {
+				return nil, false, err
+			}
+			if s.conflicts(cur, &sv) {
+				if s.opts.Conflict == ConflictReject {
+					return nil, false, status.Error(codes.AlreadyExists, fmt.Sprintf("%s/%s: %v", srv.Name, srv.Id, ErrConflict))
+				}
+				replaced = true
+			}
+		}
+		gen, err := s.nextGeneration(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+		sv.Generation = gen
+		return &sv, false, nil
+	})
+	if err != nil {
+		return nil, s.statusError(log, err)
 	}
+	sendGeneration(ctx, sv.Generation)
 
-	if _, err := s.client.Expire(ctx, srv.Name, s.opts.RedisExpiration).Result(); err != nil {
-		log.Error("expire", "err", err)
+	if replaced {
+		log.Warn(fmt.Sprintf("register name=%s, connector=%s: replaced node=%s, peer=%s", srv.Name, srv.Id, cur.Node, cur.Peer))
+		if _, err := s.client.HDel(ctx, s.keys.health(srv.Name), srv.Id).Result(); err != nil {
+			log.Error("health", "err", err)
+		}
+	}
+	if _, err := s.client.SAdd(ctx, s.keys.services(), srv.Name).Result(); err != nil {
+		log.Error("index", "err", err)
+	}
+	s.indexRenew(ctx, srv.Name, srv.Id, sv.Renew)
+	if _, err := s.client.Del(ctx, s.keys.deregistered(srv.Name, srv.Id)).Result(); err != nil {
+		log.Error("deregistered", "err", err)
+	}
+
+	action := EventUpdate
+	if cur == nil {
+		action = EventAdd
 	}
+	s.publish(ctx, action, srv.Name, newInstance(srv.Id, &sv))
 
-	log.Info(fmt.Sprintf("register name=%s, connector=%s, address=%s/%s", srv.Name, srv.Id, sv.Address, sv.Network))
+	log.Info(fmt.Sprintf("register name=%s, connector=%s, address=%s/%s, generation=%d", srv.Name, srv.Id, sv.Address, sv.Network, sv.Generation))
 	reply.Ok = true
 
 	return reply, nil
@@ -142,9 +303,39 @@ func (s *server) Deregister(ctx context.Context, in *sd_proto.DeregisterRequest)
 
 	log := slog.With("op", "deregister", "name", srv.Name, "connector", srv.Id, "node", srv.Node)
 
-	if _, err := s.client.HDel(ctx, srv.Name, srv.Id).Result(); err != nil {
-		log.Error(err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+	owner, err := s.authorize(ctx, srv.Name, false)
+	if err != nil {
+		log.Warn(err.Error())
+		return nil, err
+	}
+
+	cur, err := s.modifyInstance(ctx, srv.Name, srv.Id, func(cur *service) (*service, bool, error) {
+		if cur == nil {
+			return nil, false, nil
+		}
+		if err := checkOwner(owner, cur); err != nil {
+			return nil, false, err
+		}
+		if err := checkGeneration(ctx, srv, cur); err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	})
+	if err != nil {
+		return nil, s.statusError(log, err)
+	}
+	if cur != nil {
+		// a renewal sent before the deregistration must not recreate the instance.
+		grace := s.opts.RedisExpiration
+		if grace <= 0 {
+			grace = deregisteredGrace
+		}
+		if err := s.markDeregistered(ctx, srv.Name, srv.Id, grace); err != nil {
+			log.Error("deregistered", "err", err)
+		}
+		if err := s.forget(ctx, srv.Name, srv.Id, cur); err != nil {
+			log.Error("health", "err", err)
+		}
 	}
 	log.Info(fmt.Sprintf("deregister name=%s, connector=%s", srv.Name, srv.Id))
 
@@ -163,35 +354,36 @@ func (s *server) Renew(ctx context.Context, in *sd_proto.RenewRequest) (*sd_prot
 
 	log := slog.With("op", "renew", "name", srv.Name, "connector", srv.Id, "node", srv.Node)
 
-	v, err := s.client.HGet(ctx, srv.Name, srv.Id).Bytes()
+	owner, err := s.authorize(ctx, srv.Name, false)
 	if err != nil {
-		if err == redis.Nil {
-			return reply, nil
-		}
-		log.Error(err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		log.Warn(err.Error())
+		return nil, err
 	}
 
 	var sv service
-	if err := json.Unmarshal(v, &sv); err != nil {
-		log.Error(err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-
-	sv.Renew = time.Now().Unix()
-	if v, err = json.Marshal(sv); err != nil {
-		log.Error(err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+	cur, err := s.modifyInstance(ctx, srv.Name, srv.Id, func(cur *service) (*service, bool, error) {
+		if cur == nil {
+			return nil, false, nil
+		}
+		if err := checkOwner(owner, cur); err != nil {
+			return nil, false, err
+		}
+		if err := checkGeneration(ctx, srv, cur); err != nil {
+			return nil, false, err
+		}
+		sv = *cur
+		sv.Renew = time.Now().Unix()
+		return &sv, false, nil
+	})
+	if err != nil {
+		return nil, s.statusError(log, err)
 	}
-
-	if _, err := s.client.HSet(ctx, srv.Name, srv.Id, v).Result(); err != nil {
-		log.Error(err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+	if cur == nil {
+		return s.renewMissing(ctx, srv)
 	}
+	sendGeneration(ctx, sv.Generation)
 
-	if _, err := s.client.Expire(ctx, srv.Name, s.opts.RedisExpiration).Result(); err != nil {
-		log.Error("expire", "err", err)
-	}
+	s.indexRenew(ctx, srv.Name, srv.Id, sv.Renew)
 
 	log.Info(fmt.Sprintf("renew name=%s, connector=%s", srv.Name, srv.Id))
 	reply.Ok = true
@@ -199,6 +391,16 @@ func (s *server) Renew(ctx context.Context, in *sd_proto.RenewRequest) (*sd_prot
 	return reply, nil
 }
 
+// statusError logs err and returns it as a gRPC status error, errors without a status are internal.
+func (s *server) statusError(log *slog.Logger, err error) error {
+	if _, ok := status.FromError(err); ok {
+		log.Warn(err.Error())
+		return err
+	}
+	log.Error(err.Error())
+	return status.Error(codes.Internal, err.Error())
+}
+
 func (s *server) Get(ctx context.Context, in *sd_proto.GetServiceRequest) (*sd_proto.GetServiceReply, error) {
 	reply := &sd_proto.GetServiceReply{}
 
@@ -208,15 +410,27 @@ func (s *server) Get(ctx context.Context, in *sd_proto.GetServiceRequest) (*sd_p
 
 	log := slog.With("op", "get", "name", in.Name)
 
-	m, err := s.client.HGetAll(ctx, in.Name).Result()
+	sel, err := parseSelector(ctx)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	m, err := s.client.HGetAll(ctx, s.keys.service(in.Name)).Result()
 	if err != nil {
 		log.Error(err.Error())
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	records, err := s.healthOf(ctx, in.Name)
+	if err != nil {
+		log.Error("health", "err", err)
+	}
 
-	var srv service
-	var services []*sd_proto.Service
+	caller := s.callerLocality(ctx)
+	now := time.Now()
+	var healthy, unhealthy []weighted
 	for k, v := range m {
+		var srv service
 		if err := json.Unmarshal([]byte(v), &srv); err != nil {
 			continue
 		}
@@ -226,19 +440,30 @@ func (s *server) Get(ctx context.Context, in *sd_proto.GetServiceRequest) (*sd_p
 		if time.Since(time.Unix(srv.Renew, 0)) > s.opts.RedisExpiration {
 			continue
 		}
-		services = append(services, &sd_proto.Service{
-			Id:      k,
-			Name:    in.Name,
-			Node:    srv.Node,
-			Network: srv.Network,
-			Address: srv.Address,
-		})
+		if !sel.matches(&srv) {
+			continue
+		}
+		sv := weighted{
+			svc: &sd_proto.Service{
+				Id:      k,
+				Name:    in.Name,
+				Node:    srv.Node,
+				Network: srv.Network,
+				Address: srv.Address,
+			},
+			weight: srv.weight(),
+			tier:   caller.tier(s.instanceLocality(&srv)),
+		}
+		if records[k].down(now) {
+			unhealthy = append(unhealthy, sv)
+			continue
+		}
+		healthy = append(healthy, sv)
 	}
 
-	if len(services) > 1 {
-		rand.Shuffle(len(services), func(i, j int) {
-			services[i], services[j] = services[j], services[i]
-		})
+	services := weightedShuffle(healthy)
+	if len(services) == 0 || !s.opts.HealthExclude {
+		services = append(services, weightedShuffle(unhealthy)...)
 	}
 	log.Debug(fmt.Sprintf("get services: %+v", services))
 
@@ -0,0 +1,200 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// indexRenew records the renew time of the instance id of the service name.
+// The index expires together with the service hash.
+func (s *server) indexRenew(ctx context.Context, name, id string, renew int64) {
+	rk := s.keys.renew(name)
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, rk, &redis.Z{Score: float64(renew), Member: id})
+		pipe.Expire(ctx, rk, s.opts.RedisExpiration)
+		return nil
+	})
+	if err != nil {
+		slog.Error(fmt.Sprintf("index %s/%s: %v", name, id, err))
+	}
+}
+
+// unindexRenew drops the renew time of the instance id of the service name.
+func (s *server) unindexRenew(ctx context.Context, name, id string) {
+	if err := s.client.ZRem(ctx, s.keys.renew(name), id).Err(); err != nil {
+		slog.Error(fmt.Sprintf("unindex %s/%s: %v", name, id, err))
+	}
+}
+
+// runSweeper deletes the instances not renewed within Options.RedisExpiration every Options.SweepInterval.
+func (s *server) runSweeper(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sweepAll(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *server) sweepAll(ctx context.Context) {
+	// with several replicas, only one of them sweeps per interval.
+	ok, err := s.client.SetNX(ctx, s.keys.sweep(), 1, s.opts.SweepInterval/2).Result()
+	if err != nil || !ok {
+		if err != nil {
+			slog.Error(fmt.Sprintf("sweep: %v", err))
+		}
+		return
+	}
+
+	names, err := s.client.SMembers(ctx, s.keys.services()).Result()
+	if err != nil {
+		slog.Error(fmt.Sprintf("sweep: %v", err))
+		return
+	}
+	for _, name := range names {
+		if err := s.sweep(ctx, name); err != nil {
+			slog.Error(fmt.Sprintf("sweep %s: %v", name, err))
+		}
+	}
+}
+
+// sweep deletes the stale instances of the service name.
+// The name is dropped from the services set once no instance is left.
+func (s *server) sweep(ctx context.Context, name string) error {
+	if err := s.backfillRenew(ctx, name); err != nil {
+		return err
+	}
+
+	rk := s.keys.renew(name)
+	key := s.keys.service(name)
+	deadline := time.Now().Add(-s.opts.RedisExpiration).Unix()
+
+	var stale []string
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		stale = nil
+		ids, err := tx.ZRangeByScore(ctx, rk, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: "(" + strconv.FormatInt(deadline, 10),
+		}).Result()
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		// the index is updated after the instance, re-check the renew time
+		// of the instance itself so that a renewal in between is kept.
+		vs, err := tx.HMGet(ctx, key, ids...).Result()
+		if err != nil {
+			return err
+		}
+		var gone []string
+		for i, id := range ids {
+			if v, ok := vs[i].(string); ok {
+				var sv service
+				if json.Unmarshal([]byte(v), &sv) == nil && sv.Renew >= deadline {
+					continue
+				}
+				stale = append(stale, id)
+			}
+			gone = append(gone, id)
+		}
+		if len(gone) == 0 {
+			return nil
+		}
+		members := make([]any, len(gone))
+		for i := range gone {
+			members[i] = gone[i]
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(stale) > 0 {
+				pipe.HDel(ctx, key, stale...)
+			}
+			pipe.HDel(ctx, s.keys.health(name), gone...)
+			pipe.ZRem(ctx, rk, members...)
+			return nil
+		})
+		return err
+	}, rk, key)
+	if err == redis.TxFailedErr {
+		// renewed in between, try again next time.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, id := range stale {
+		slog.Info(fmt.Sprintf("sweep name=%s, connector=%s", name, id))
+		s.publish(ctx, EventRemove, name, Instance{ID: id})
+	}
+
+	return s.releaseName(ctx, name)
+}
+
+// releaseName drops the service name from the service index and its owner once no
+// instance is left, so that the name may be claimed again.
+func (s *server) releaseName(ctx context.Context, name string) error {
+	key := s.keys.service(name)
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, key).Result()
+		if err != nil || n > 0 {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SRem(ctx, s.keys.services(), name)
+			pipe.HDel(ctx, s.keys.owners(), name)
+			return nil
+		})
+		return err
+	}, key, s.keys.owners())
+	if err == redis.TxFailedErr {
+		// registered or claimed in between.
+		return nil
+	}
+	return err
+}
+
+// backfillRenew indexes the instances of the service name that have no renew time
+// in the index, such as those registered by older versions.
+func (s *server) backfillRenew(ctx context.Context, name string) error {
+	hlen, err := s.client.HLen(ctx, s.keys.service(name)).Result()
+	if err != nil {
+		return err
+	}
+	zlen, err := s.client.ZCard(ctx, s.keys.renew(name)).Result()
+	if err != nil || zlen >= hlen {
+		return err
+	}
+
+	m, err := s.client.HGetAll(ctx, s.keys.service(name)).Result()
+	if err != nil {
+		return err
+	}
+	var zs []*redis.Z
+	for id, v := range m {
+		var sv service
+		if err := json.Unmarshal([]byte(v), &sv); err != nil {
+			continue
+		}
+		zs = append(zs, &redis.Z{Score: float64(sv.Renew), Member: id})
+	}
+	if len(zs) == 0 {
+		return nil
+	}
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAddNX(ctx, s.keys.renew(name), zs...)
+		pipe.Expire(ctx, s.keys.renew(name), s.opts.RedisExpiration)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,339 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ginuerzh/gost-plugins/internal/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// WatchMethod is the full name of the server streaming gRPC method of the watch API.
+	// Its messages are JSON encoded, see Watch.
+	WatchMethod = "/gost.sd.Watch/Watch"
+
+	// content subtype of the JSON codec of the watch API
+	jsonCodecName = "json"
+
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 5 * time.Minute
+	sseKeepAlive       = 15 * time.Second
+)
+
+var (
+	errWatchDisabled = errors.New("watch: events are disabled")
+	errWatcherSlow   = errors.New("watch: watcher too slow")
+)
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// jsonCodec encodes the gRPC messages of the watch API as JSON,
+// selected by the "application/grpc+json" content type.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return jsonCodecName }
+
+// adminWatchReply is the reply of a long-poll of the admin watch API.
+type adminWatchReply struct {
+	// revision of the instances, the revision query parameter of the next poll
+	Revision string `json:"revision"`
+	// the instances, null if they did not change since the requested revision
+	Instances []Instance `json:"instances"`
+}
+
+// WatchRequest is the request of the watch API.
+type WatchRequest struct {
+	// service name
+	Name string `json:"name"`
+}
+
+type watchService interface {
+	watch(in *WatchRequest, stream grpc.ServerStream) error
+}
+
+var watchServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gost.sd.Watch",
+	HandlerType: (*watchService)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				in := &WatchRequest{}
+				if err := stream.RecvMsg(in); err != nil {
+					return err
+				}
+				return srv.(watchService).watch(in, stream)
+			},
+		},
+	},
+}
+
+// Watch calls the watch API of the SD server on cc for the service name.
+// fn is called with the current instances as EventAdd events, then with
+// every change until ctx is done or fn returns an error.
+func Watch(ctx context.Context, cc grpc.ClientConnInterface, name string, fn func(*Event) error) error {
+	stream, err := cc.NewStream(ctx, &watchServiceDesc.Streams[0], WatchMethod, grpc.CallContentSubtype(jsonCodecName))
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(&WatchRequest{Name: name}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		ev := &Event{}
+		if err := stream.RecvMsg(ev); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *server) watch(in *WatchRequest, stream grpc.ServerStream) error {
+	if in.Name == "" {
+		return status.Error(codes.InvalidArgument, "invalid args")
+	}
+	if s.opts.EventChannel == "" {
+		return status.Error(codes.FailedPrecondition, errWatchDisabled.Error())
+	}
+
+	ctx := stream.Context()
+	w := s.watchers.add(in.Name)
+	defer s.watchers.remove(w)
+
+	snapshot, err := s.snapshot(ctx, in.Name)
+	if err != nil {
+		slog.Error(fmt.Sprintf("watch %s: %v", in.Name, err))
+		return status.Error(codes.Internal, err.Error())
+	}
+	for _, ev := range snapshot {
+		if err := stream.SendMsg(ev); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-w.ch:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, errWatcherSlow.Error())
+			}
+			if err := stream.SendMsg(ev); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// instances returns the instances of the service name renewed within Options.RedisExpiration, ordered by ID.
+func (s *server) instances(ctx context.Context, name string) ([]Instance, error) {
+	m, err := s.client.HGetAll(ctx, s.keys.service(name)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []Instance
+	for id, v := range m {
+		var sv service
+		if err := json.Unmarshal([]byte(v), &sv); err != nil {
+			continue
+		}
+		if time.Since(time.Unix(sv.Renew, 0)) > s.opts.RedisExpiration {
+			continue
+		}
+		instances = append(instances, newInstance(id, &sv))
+	}
+	slices.SortFunc(instances, func(a, b Instance) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return instances, nil
+}
+
+// revision returns a digest of the instances, ignoring their renew times,
+// which changes whenever an instance is added, updated or removed.
+func revision(instances []Instance) string {
+	h := fnv.New64a()
+	enc := json.NewEncoder(h)
+	for _, inst := range instances {
+		inst.Renew = 0
+		enc.Encode(inst)
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// snapshot returns the current instances of the service name as EventAdd events.
+func (s *server) snapshot(ctx context.Context, name string) ([]*Event, error) {
+	instances, err := s.instances(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	events := make([]*Event, 0, len(instances))
+	for _, inst := range instances {
+		events = append(events, &Event{
+			Name:     name,
+			Action:   EventAdd,
+			Instance: inst,
+			Time:     now,
+		})
+	}
+	return events, nil
+}
+
+// watch streams the events of a service as server-sent events if the client accepts
+// text/event-stream. Otherwise it long-polls: the reply carries the instances as soon
+// as they differ from the revision query parameter, the revision of a former reply,
+// or the unchanged revision alone once the timeout query parameter elapses.
+// Without a revision the current instances are returned at once, so changes between
+// polls are never lost.
+func (s *adminServer) watch(w http.ResponseWriter, r *http.Request) {
+	if s.srv.opts.EventChannel == "" {
+		writeAdminReply(w, http.StatusServiceUnavailable, errWatchDisabled)
+		return
+	}
+
+	name := r.PathValue("name")
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.stream(w, r, name)
+		return
+	}
+
+	q := r.URL.Query()
+	timeout := defaultPollTimeout
+	if v := q.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeAdminReply(w, http.StatusBadRequest, fmt.Errorf("invalid timeout: %s", v))
+			return
+		}
+		timeout = min(d, maxPollTimeout)
+	}
+
+	// watching before reading the instances, no change in between is missed.
+	wr := s.srv.watchers.add(name)
+	defer s.srv.watchers.remove(wr)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		instances, err := s.srv.instances(r.Context(), name)
+		if err != nil {
+			writeAdminReply(w, http.StatusInternalServerError, err)
+			return
+		}
+		reply := adminWatchReply{Revision: revision(instances)}
+		if reply.Revision != q.Get("revision") {
+			reply.Instances = append([]Instance{}, instances...)
+			util.WriteJSON(w, http.StatusOK, reply)
+			return
+		}
+
+		select {
+		case _, ok := <-wr.ch:
+			if !ok {
+				writeAdminReply(w, http.StatusServiceUnavailable, errWatcherSlow)
+				return
+			}
+			// read the instances again after the events published together.
+			for len(wr.ch) > 0 {
+				<-wr.ch
+			}
+		case <-timer.C:
+			util.WriteJSON(w, http.StatusOK, reply)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *adminServer) stream(w http.ResponseWriter, r *http.Request, name string) {
+	rc := http.NewResponseController(w)
+	ctx := r.Context()
+
+	wr := s.srv.watchers.add(name)
+	defer s.srv.watchers.remove(wr)
+
+	snapshot, err := s.srv.snapshot(ctx, name)
+	if err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(ev *Event) error {
+		v, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Action, v); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	for _, ev := range snapshot {
+		if err := send(ev); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev, ok := <-wr.ch:
+			if !ok {
+				return
+			}
+			if err := send(ev); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
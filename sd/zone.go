@@ -0,0 +1,156 @@
+package sd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Locality tiers of an instance relative to the caller of Get, nearer first.
+const (
+	tierZone = iota
+	tierRegion
+	tierOther
+)
+
+// locality is the zone and region of a caller or an instance.
+type locality struct {
+	Zone   string `json:"zone"`
+	Region string `json:"region"`
+}
+
+// zoneEntry is a network of the zone file with its locality.
+type zoneEntry struct {
+	prefix netip.Prefix
+	loc    locality
+}
+
+// zoneMap maps IP addresses to localities, loaded from the zone file which maps
+// CIDR networks to their zone and region:
+//
+//	{
+//	  "10.1.0.0/16": {"zone": "eu-1a", "region": "eu-1"},
+//	  "10.2.0.0/16": {"zone": "eu-1b", "region": "eu-1"}
+//	}
+//
+// The longest matching network wins.
+type zoneMap []zoneEntry
+
+func loadZoneMap(file string) (zoneMap, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg map[string]locality
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	var zm zoneMap
+	for cidr, loc := range cfg {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("zone file: %w", err)
+		}
+		if loc.Zone == "" && loc.Region == "" {
+			return nil, fmt.Errorf("zone file: %s: zone or region is required", cidr)
+		}
+		zm = append(zm, zoneEntry{prefix: prefix.Masked(), loc: loc})
+	}
+	// longest prefixes first
+	slices.SortFunc(zm, func(a, b zoneEntry) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+	return zm, nil
+}
+
+// lookup returns the locality of the host, an IP address optionally with a port.
+func (zm zoneMap) lookup(host string) (locality, bool) {
+	if len(zm) == 0 {
+		return locality{}, false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return locality{}, false
+	}
+	ip = ip.Unmap()
+	for _, e := range zm {
+		if e.prefix.Contains(ip) {
+			return e.loc, true
+		}
+	}
+	return locality{}, false
+}
+
+// region returns the region of the zone, empty if it is not in the map.
+func (zm zoneMap) region(zone string) string {
+	for _, e := range zm {
+		if e.loc.Zone == zone && e.loc.Region != "" {
+			return e.loc.Region
+		}
+	}
+	return ""
+}
+
+// callerLocality returns the locality of the caller of Get: the zone and region
+// request metadata if the caller supplies them, the locality of its peer address otherwise.
+func (s *server) callerLocality(ctx context.Context) locality {
+	var loc locality
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		loc.Zone = mdValue(md, metaZone)
+		loc.Region = mdValue(md, metaRegion)
+	}
+	if loc.Zone != "" && loc.Region == "" {
+		loc.Region = s.zones.region(loc.Zone)
+	}
+	if loc.Zone != "" || loc.Region != "" {
+		return loc
+	}
+	if p, _ := peer.FromContext(ctx); p != nil && p.Addr != nil {
+		loc, _ = s.zones.lookup(p.Addr.String())
+	}
+	return loc
+}
+
+// instanceLocality returns the locality of the instance sv: its zone and region
+// labels, or the zone of its address for those it did not register.
+func (s *server) instanceLocality(sv *service) locality {
+	loc := locality{Zone: sv.Zone, Region: sv.Region}
+	if loc.Zone != "" && loc.Region != "" {
+		return loc
+	}
+	if l, ok := s.zones.lookup(sv.Address); ok {
+		if loc.Zone == "" {
+			loc.Zone = l.Zone
+		}
+		if loc.Region == "" {
+			loc.Region = l.Region
+		}
+	}
+	return loc
+}
+
+// tier returns the locality tier of an instance at loc for the caller at c.
+// Every instance is in tierZone for a caller of unknown locality.
+func (c locality) tier(loc locality) int {
+	switch {
+	case c.Zone == "" && c.Region == "":
+		return tierZone
+	case c.Zone != "" && c.Zone == loc.Zone:
+		return tierZone
+	case c.Region != "" && c.Region == loc.Region:
+		return tierRegion
+	default:
+		return tierOther
+	}
+}
@@ -0,0 +1,119 @@
+package sd
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZoneLookup(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "zones.json")
+	data := `{
+		"10.0.0.0/8": {"region": "eu-1"},
+		"10.1.0.0/16": {"zone": "eu-1a", "region": "eu-1"},
+		"10.1.2.0/24": {"zone": "eu-1c", "region": "eu-1"},
+		"10.2.0.0/16": {"zone": "eu-1b", "region": "eu-1"},
+		"2001:db8::/32": {"zone": "us-1a", "region": "us-1"}
+	}`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	zm, err := loadZoneMap(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want locality
+		ok   bool
+	}{
+		{"10.1.0.1", locality{Zone: "eu-1a", Region: "eu-1"}, true},
+		{"10.1.0.1:8080", locality{Zone: "eu-1a", Region: "eu-1"}, true},
+		{"10.1.2.3", locality{Zone: "eu-1c", Region: "eu-1"}, true},
+		{"10.2.0.1", locality{Zone: "eu-1b", Region: "eu-1"}, true},
+		{"10.3.0.1", locality{Region: "eu-1"}, true},
+		{"::ffff:10.2.0.1", locality{Zone: "eu-1b", Region: "eu-1"}, true},
+		{"[2001:db8::1]:8080", locality{Zone: "us-1a", Region: "us-1"}, true},
+		{"192.168.0.1", locality{}, false},
+		{"example.com:8080", locality{}, false},
+		{"", locality{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := zm.lookup(tt.host)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("lookup(%q) = %+v, %v, want %+v, %v", tt.host, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	if got := zm.region("eu-1b"); got != "eu-1" {
+		t.Errorf("region(%q) = %q, want %q", "eu-1b", got, "eu-1")
+	}
+	if got := zm.region("ap-1a"); got != "" {
+		t.Errorf("region(%q) = %q, want empty", "ap-1a", got)
+	}
+	if _, ok := zoneMap(nil).lookup("10.1.0.1"); ok {
+		t.Error("lookup in an empty zone map succeeded")
+	}
+}
+
+func TestLoadZoneMapInvalid(t *testing.T) {
+	for _, data := range []string{
+		`{"10.1.0.0": {"zone": "eu-1a"}}`,
+		`{"10.1.0.0/16": {}}`,
+		`[]`,
+	} {
+		file := filepath.Join(t.TempDir(), "zones.json")
+		if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadZoneMap(file); err == nil {
+			t.Errorf("loadZoneMap(%s) succeeded", data)
+		}
+	}
+}
+
+func TestLocalityTier(t *testing.T) {
+	tests := []struct {
+		caller, loc locality
+		want        int
+	}{
+		{locality{}, locality{Zone: "eu-1a", Region: "eu-1"}, tierZone},
+		{locality{}, locality{}, tierZone},
+		{locality{Zone: "eu-1a", Region: "eu-1"}, locality{Zone: "eu-1a", Region: "eu-1"}, tierZone},
+		{locality{Zone: "eu-1a", Region: "eu-1"}, locality{Zone: "eu-1b", Region: "eu-1"}, tierRegion},
+		{locality{Zone: "eu-1a", Region: "eu-1"}, locality{Zone: "us-1a", Region: "us-1"}, tierOther},
+		{locality{Zone: "eu-1a", Region: "eu-1"}, locality{}, tierOther},
+		{locality{Zone: "eu-1a"}, locality{Zone: "eu-1a"}, tierZone},
+		{locality{Zone: "eu-1a"}, locality{Zone: "eu-1b"}, tierOther},
+		{locality{Region: "eu-1"}, locality{Zone: "eu-1b", Region: "eu-1"}, tierRegion},
+		{locality{Region: "eu-1"}, locality{Region: "us-1"}, tierOther},
+	}
+	for _, tt := range tests {
+		if got := tt.caller.tier(tt.loc); got != tt.want {
+			t.Errorf("%+v.tier(%+v) = %d, want %d", tt.caller, tt.loc, got, tt.want)
+		}
+	}
+}
+
+func TestInstanceLocality(t *testing.T) {
+	s := &server{zones: zoneMap{
+		{prefix: netip.MustParsePrefix("10.1.0.0/16"), loc: locality{Zone: "eu-1a", Region: "eu-1"}},
+	}}
+
+	tests := []struct {
+		sv   service
+		want locality
+	}{
+		{service{Address: "10.1.0.1:80"}, locality{Zone: "eu-1a", Region: "eu-1"}},
+		{service{Address: "10.1.0.1:80", Zone: "eu-1b"}, locality{Zone: "eu-1b", Region: "eu-1"}},
+		{service{Address: "10.1.0.1:80", Zone: "us-1a", Region: "us-1"}, locality{Zone: "us-1a", Region: "us-1"}},
+		{service{Address: "192.168.0.1:80"}, locality{}},
+	}
+	for _, tt := range tests {
+		if got := s.instanceLocality(&tt.sv); got != tt.want {
+			t.Errorf("instanceLocality(%+v) = %+v, want %+v", tt.sv, got, tt.want)
+		}
+	}
+}